@@ -5,13 +5,23 @@
 package hash
 
 import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/json"
 	"flag"
 	"fmt"
+	"hash/crc32"
+	"io"
 	"math"
+	"math/big"
 	"os"
 	"path"
+	"path/filepath"
 	"runtime"
+	"sort"
 	"strings"
+	"sync"
 	"testing"
 
 	"github.com/cznic/mathutil"
@@ -295,6 +305,1452 @@ func TestMap(t *testing.T) {
 	}
 }
 
+func TestMaphash(t *testing.T) {
+	a := rnda(100000)
+	m := NewMaphash(WriteBytes, func(a, b interface{}) bool { return bytes.Equal(a.([]byte), b.([]byte)) }, 0)
+	for v, key := range a {
+		m.Insert([]byte(fmt.Sprint(key)), v)
+	}
+	if g, e := m.Len(), len(a); g != e {
+		t.Fatal(g, e)
+	}
+
+	for v, key := range a {
+		g, ok := m.Get([]byte(fmt.Sprint(key)))
+		if !ok || g != v {
+			t.Fatal(ok, g, v)
+		}
+	}
+
+	type pair [2]int
+	m = NewMaphash(WriteComparable[pair], func(a, b interface{}) bool { return a == b }, 0)
+	for i := 0; i < 1000; i++ {
+		m.Insert(pair{i, -i}, i)
+	}
+	for i := 0; i < 1000; i++ {
+		g, ok := m.Get(pair{i, -i})
+		if !ok || g != i {
+			t.Fatal(ok, g, i)
+		}
+
+		if _, ok := m.Get(pair{i, i + 1}); ok {
+			t.Fatal(i)
+		}
+	}
+}
+
+func TestStats(t *testing.T) {
+	a := rnda(100000)
+	m := New(fnv, cmp, 4)
+	for v, key := range a {
+		m.Insert(key, int64(v))
+	}
+	for _, key := range a[:len(a)/2] {
+		m.Delete(key)
+	}
+
+	s := m.Stats()
+	if g, e := s.Len, m.Len(); g != e {
+		t.Fatal(g, e)
+	}
+
+	if g, e := s.Buckets, len(m.items); g != e {
+		t.Fatal(g, e)
+	}
+
+	if g, e := s.InitialBuckets, 4; g != e {
+		t.Fatal(g, e)
+	}
+
+	buckets, items := 0, 0
+	for n, v := range s.Histogram {
+		buckets += v
+		items += n * v
+	}
+	if g, e := buckets, s.Buckets; g != e {
+		t.Fatal(g, e)
+	}
+
+	if g, e := items, s.Len; g != e {
+		t.Fatal(g, e)
+	}
+
+	if g, e := s.Histogram[0], s.EmptyBuckets; g != e {
+		t.Fatal(g, e)
+	}
+
+	if g, e := len(s.Histogram)-1, s.MaxChain; g != e {
+		t.Fatal(g, e)
+	}
+
+	if s.ProbesHit < 1 || s.ProbesMiss <= 0 || s.Tombstones == 0 || s.Bytes <= 0 {
+		t.Fatalf("%+v", s)
+	}
+}
+
+func fnvBytes(k interface{}) int64 {
+	h := uint64(offset64)
+	for _, c := range k.([]byte) {
+		h ^= uint64(c)
+		h *= prime64
+	}
+	return int64(h)
+}
+
+func cmpBytes(a, b interface{}) bool { return bytes.Equal(a.([]byte), b.([]byte)) }
+
+func TestVerify(t *testing.T) {
+	for initialCap := 1; initialCap <= 16; initialCap <<= 1 {
+		a := rnda(10000)
+		m := New(fnv, cmp, initialCap)
+		for v, key := range a {
+			m.Insert(key, int64(v))
+			if v%1000 == 0 {
+				if err := m.Verify(); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+		for _, key := range a[:len(a)/2] {
+			m.Delete(key)
+		}
+		if err := m.Verify(); err != nil {
+			t.Fatal(err)
+		}
+
+		m.Vacuum()
+		if err := m.Verify(); err != nil {
+			t.Fatal(err)
+		}
+
+		m.len++
+		if m.Verify() == nil {
+			t.Fatal("expected error")
+		}
+	}
+
+	m := New(fnvBytes, cmpBytes, 0)
+	var keys [][]byte
+	for i := 0; i < 1000; i++ {
+		k := []byte(fmt.Sprint(i))
+		keys = append(keys, k)
+		m.Insert(k, i)
+	}
+	if err := m.Verify(); err != nil {
+		t.Fatal(err)
+	}
+
+	keys[42][0]++
+	err := m.Verify()
+	if err == nil {
+		t.Fatal("expected error")
+	}
+
+	t.Log(err)
+}
+
+func TestCheckedCursor(t *testing.T) {
+	a := rnda(1000)
+	m := New(fnv, cmp, 0)
+	for v, key := range a {
+		m.Insert(key, int64(v))
+	}
+
+	n := 0
+	for c := m.CheckedCursor(false); c.Next(); n++ {
+		m.Insert(c.K, -c.V.(int64))
+	}
+	if g, e := n, len(a); g != e {
+		t.Fatal(g, e)
+	}
+
+	c := m.CheckedCursor(false)
+	for i := int64(0); c.Next(); i++ {
+		m.Insert(i, i)
+	}
+	if g, e := c.Err(), ErrModified; g != e {
+		t.Fatal(g, e)
+	}
+
+	func() {
+		defer func() {
+			if g, e := recover(), ErrModified; g != e {
+				t.Fatal(g, e)
+			}
+		}()
+
+		c := m.CheckedCursor(true)
+		c.Next()
+		m.Vacuum()
+		c.Next()
+		t.Fatal("expected panic")
+	}()
+}
+
+func TestCursorDelete(t *testing.T) {
+	a := rnda(100000)
+	m := New(fnv, cmp, 0)
+	for v, key := range a {
+		m.Insert(key, int64(v))
+	}
+
+	seen := map[int64]bool{}
+	for c := m.Cursor(); c.Next(); {
+		k := c.K.(int64)
+		if seen[k] {
+			t.Fatal("item produced twice")
+		}
+
+		seen[k] = true
+		switch v := c.V.(int64); v % 3 {
+		case 0:
+			c.Delete()
+		case 1:
+			c.SetValue(-v)
+		}
+	}
+	if g, e := len(seen), len(a); g != e {
+		t.Fatal(g, e)
+	}
+
+	if err := m.Verify(); err != nil {
+		t.Fatal(err)
+	}
+
+	m.DeleteFunc(func(k, v interface{}) bool { return v.(int64) < 0 })
+	for v, key := range a {
+		g, ok := m.Get(key)
+		switch v % 3 {
+		case 2:
+			if !ok || g != int64(v) {
+				t.Fatal(v, ok, g)
+			}
+		default:
+			if ok {
+				t.Fatal(v, g)
+			}
+		}
+	}
+	if err := m.Verify(); err != nil {
+		t.Fatal(err)
+	}
+
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Fatal("expected panic")
+			}
+		}()
+
+		c := m.Cursor()
+		c.Next()
+		c.Delete()
+		c.Delete()
+	}()
+}
+
+func TestCursorAt(t *testing.T) {
+	for initialCap := 1; initialCap <= 16; initialCap <<= 1 {
+		a := rnda(20000)
+		m := New(fnv, cmp, initialCap)
+		// Items a[:10000] are present for the whole scan.
+		for v, key := range a[:15000] {
+			m.Insert(key, int64(v))
+		}
+
+		seen := map[int64]int{}
+		var p Position
+		for page := 0; !p.End(); page++ {
+			c := m.CursorAt(p)
+			for i := 0; i < 7 && c.Next(); i++ {
+				seen[c.K.(int64)]++
+			}
+			b, err := c.Position().MarshalBinary()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if err := p.UnmarshalBinary(b); err != nil {
+				t.Fatal(err)
+			}
+
+			switch {
+			case page < 1000:
+				m.Insert(a[15000+page], int64(15000+page))
+			case page < 2000:
+				m.Delete(a[10000+page])
+			case page == 2000:
+				m.Vacuum()
+			}
+		}
+		for _, key := range a[:10000] {
+			switch n := seen[key]; {
+			case n == 0:
+				t.Fatalf("initialCap %d, key %d not produced", initialCap, key)
+			case n > 1:
+				t.Fatalf("initialCap %d, key %d produced %d times", initialCap, key, n)
+			}
+		}
+	}
+}
+
+func TestPartitions(t *testing.T) {
+	a := rnda(100000)
+	m := New(fnv, cmp, 0)
+	for v, key := range a {
+		m.Insert(key, int64(v))
+	}
+
+	for _, n := range []int{1, 3, 8} {
+		cs := m.Partitions(n)
+		if g, e := len(cs), n; g != e {
+			t.Fatal(g, e)
+		}
+
+		seen := make([]map[int64]bool, n)
+		var wg sync.WaitGroup
+		for i, c := range cs {
+			wg.Add(1)
+			go func(i int, c *Cursor) {
+				defer wg.Done()
+
+				seen[i] = map[int64]bool{}
+				for c.Next() {
+					seen[i][c.K.(int64)] = true
+				}
+			}(i, c)
+		}
+		wg.Wait()
+		all := map[int64]bool{}
+		for _, s := range seen {
+			for k := range s {
+				if all[k] {
+					t.Fatal("item produced twice")
+				}
+
+				all[k] = true
+			}
+		}
+		if g, e := len(all), len(a); g != e {
+			t.Fatal(g, e)
+		}
+	}
+
+	if g, e := len(New(fnv, cmp, 0).Partitions(4)), 1; g != e {
+		t.Fatal(g, e)
+	}
+}
+
+func TestParallelCloneVacuum(t *testing.T) {
+	a := rnda(100000)
+	m := New(fnv, cmp, 0)
+	for v, key := range a {
+		m.Insert(key, int64(v))
+	}
+
+	m2 := m.ParallelClone(4)
+	if err := m2.Verify(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range a[:len(a)/2] {
+		m2.Delete(key)
+	}
+	if g, e := m.Len(), len(a); g != e {
+		t.Fatal(g, e)
+	}
+
+	m2.ParallelVacuum(4)
+	if err := m2.Verify(); err != nil {
+		t.Fatal(err)
+	}
+
+	if g, e := m2.Len(), len(a)/2; g != e {
+		t.Fatal(g, e)
+	}
+
+	for v, key := range a {
+		g, ok := m.Get(key)
+		if !ok || g != int64(v) {
+			t.Fatal(ok, g, v)
+		}
+
+		g, ok = m2.Get(key)
+		if ok != (v >= len(a)/2) || ok && g != int64(v) {
+			t.Fatal(ok, g, v)
+		}
+	}
+
+	for v, key := range rnda(1000) {
+		m2.Insert(key+1, int64(v))
+	}
+	if err := m2.Verify(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDeterministicOrder(t *testing.T) {
+	a := rnda(10000)
+	m := New(fnv, cmp, 1)
+	for v, key := range a {
+		m.Insert(key, int64(v))
+	}
+	m2 := New(fnv, cmp, 64)
+	for i := len(a) - 1; i >= 0; i-- {
+		m2.Insert(a[i], int64(i))
+		m2.Insert(a[i]+1, int64(i))
+		m2.Delete(a[i] + 1)
+	}
+
+	enum := func(c *Cursor) (r []int64) {
+		for c.Next() {
+			r = append(r, c.K.(int64))
+		}
+		return r
+	}
+
+	less := func(a, b interface{}) bool { return a.(int64) < b.(int64) }
+	s, s2 := enum(m.SortedCursor(less)), enum(m2.SortedCursor(less))
+	if g, e := len(s), len(a); g != e {
+		t.Fatal(g, e)
+	}
+
+	if g, e := fmt.Sprint(s2), fmt.Sprint(s); g != e {
+		t.Fatal("different order")
+	}
+
+	for i := 1; i < len(s); i++ {
+		if s[i-1] >= s[i] {
+			t.Fatal("not sorted")
+		}
+	}
+
+	s, s2 = enum(m.CursorAt(Position{})), enum(m2.CursorAt(Position{}))
+	if g, e := len(s), len(a); g != e {
+		t.Fatal(g, e)
+	}
+
+	if g, e := fmt.Sprint(s2), fmt.Sprint(s); g != e {
+		t.Fatal("different order")
+	}
+}
+
+func TestCloneClearReset(t *testing.T) {
+	a := rnda(10000)
+	m := New(fnv, cmp, 4)
+	for v, key := range a {
+		m.Insert(key, int64(v))
+	}
+
+	m2 := m.Clone()
+	if err := m2.Verify(); err != nil {
+		t.Fatal(err)
+	}
+
+	buckets := len(m.items)
+	m.Clear()
+	if g, e := m.Len(), 0; g != e {
+		t.Fatal(g, e)
+	}
+
+	if g, e := len(m.items), buckets; g != e {
+		t.Fatal(g, e)
+	}
+
+	if err := m.Verify(); err != nil {
+		t.Fatal(err)
+	}
+
+	for v, key := range a {
+		if _, ok := m.Get(key); ok {
+			t.Fatal(v)
+		}
+
+		if g, ok := m2.Get(key); !ok || g != int64(v) {
+			t.Fatal(ok, g, v)
+		}
+	}
+
+	for v, key := range a {
+		m.Insert(key, int64(v))
+	}
+	if err := m.Verify(); err != nil {
+		t.Fatal(err)
+	}
+
+	if g, e := m.Len(), len(a); g != e {
+		t.Fatal(g, e)
+	}
+
+	m2.Reset()
+	if g, e := len(m2.items), 4; g != e {
+		t.Fatal(g, e)
+	}
+
+	if err := m2.Verify(); err != nil {
+		t.Fatal(err)
+	}
+
+	for v, key := range a {
+		if g, ok := m.Get(key); !ok || g != int64(v) {
+			t.Fatal(ok, g, v)
+		}
+
+		if _, ok := m2.Get(key); ok {
+			t.Fatal(v)
+		}
+	}
+}
+
+func TestGrow(t *testing.T) {
+	a := rnda(100000)
+	m := New(fnv, cmp, 0)
+	for v, key := range a[:1000] {
+		m.Insert(key, int64(v))
+	}
+	m.Grow(len(a) - 1000)
+	if err := m.Verify(); err != nil {
+		t.Fatal(err)
+	}
+
+	buckets, mod := len(m.items), m.mod
+	for v, key := range a[1000:] {
+		m.Insert(key, int64(v+1000))
+	}
+	if g, e := len(m.items), buckets; g != e {
+		t.Fatal(g, e)
+	}
+
+	if g, e := m.mod, mod; g != e {
+		t.Fatal(g, e)
+	}
+
+	if err := m.Verify(); err != nil {
+		t.Fatal(err)
+	}
+
+	for v, key := range a {
+		if g, ok := m.Get(key); !ok || g != int64(v) {
+			t.Fatal(ok, g, v)
+		}
+	}
+
+	if s := m.Stats(); s.ProbesHit > 3 {
+		t.Fatalf("%+v", s)
+	}
+}
+
+func TestBatch(t *testing.T) {
+	a := rnda(100000)
+	keys := make([]interface{}, len(a))
+	values := make([]interface{}, len(a))
+	for i, k := range a {
+		keys[i] = k
+		values[i] = int64(i)
+	}
+	keys[10] = keys[20]
+	m := New(fnv, cmp, 0)
+	m.Insert(a[0], int64(-1))
+	m.InsertBatch(keys, values)
+	if err := m.Verify(); err != nil {
+		t.Fatal(err)
+	}
+
+	if g, e := m.Len(), len(a)-1; g != e {
+		t.Fatal(g, e)
+	}
+
+	if g, _ := m.Get(a[20]); g != int64(20) {
+		t.Fatal(g)
+	}
+
+	// Reinserting the keys does not leave room reserved for them.
+	m.InsertBatch(keys, values)
+	if m.reserve != 0 {
+		t.Fatal(m.reserve)
+	}
+
+	keys[10] = a[10] + 1
+	out := make([]interface{}, len(keys))
+	if g, e := m.GetBatch(keys, out), len(a)-1; g != e {
+		t.Fatal(g, e)
+	}
+
+	for i, v := range out {
+		switch {
+		case i == 10:
+			if v != nil {
+				t.Fatal(i, v)
+			}
+		default:
+			if v != int64(i) {
+				t.Fatal(i, v)
+			}
+		}
+	}
+}
+
+func TestHashed(t *testing.T) {
+	a := rnda(100000)
+	m := New(fnv, cmp, 0)
+	m2 := New(fnv, cmp, 0)
+	for v, key := range a {
+		h := fnv(key)
+		m.InsertHashed(h, key, int64(v))
+		m2.InsertHashed(h, key, -int64(v))
+	}
+	if err := m.Verify(); err != nil {
+		t.Fatal(err)
+	}
+
+	for v, key := range a {
+		h := fnv(key)
+		if g, ok := m.GetHashed(h, key); !ok || g != int64(v) {
+			t.Fatal(ok, g, v)
+		}
+
+		if g, ok := m2.GetHashed(h, key); !ok || g != -int64(v) {
+			t.Fatal(ok, g, v)
+		}
+
+		if v%2 == 0 {
+			m.DeleteHashed(h, key)
+		}
+	}
+	for v, key := range a {
+		if _, ok := m.Get(key); ok != (v%2 != 0) {
+			t.Fatal(ok, v)
+		}
+	}
+}
+
+func TestEqualDiffMerge(t *testing.T) {
+	a := rnda(10000)
+	m := New(fnv, cmp, 0)
+	for v, key := range a {
+		m.Insert(key, int64(v))
+	}
+	valueEq := func(a, b interface{}) bool { return a.(int64) == b.(int64) }
+	for _, m2 := range []*Map{m.Clone(), m.ParallelClone(3)} {
+		m3 := New(fnv, cmp, 16) // Not sharing the hash function of m.
+		m4 := m.NewLike(16)     // Sharing the hash function, different layout.
+		for c := m.Cursor(); c.Next(); {
+			m3.Insert(c.K, c.V)
+			m4.Insert(c.K, c.V)
+		}
+		for _, m2 := range []*Map{m2, m3, m4} {
+			if !Equal(m, m2, valueEq) || !Equal(m2, m, valueEq) {
+				t.Fatal("not equal")
+			}
+		}
+
+		m2.Insert(a[0], int64(-1))
+		m2.Delete(a[1])
+		m2.Delete(a[2])
+		if !sameLayout(m, m2) {
+			t.Fatal("expected same layout")
+		}
+
+		added, removed, changed := Diff(m, m2, valueEq)
+		if g, e := fmt.Sprint(added, sorted(removed), changed), fmt.Sprint([]int64{}, sorted([]interface{}{a[1], a[2]}), []int64{a[0]}); g != e {
+			t.Fatal(g, e)
+		}
+
+		m2.Insert(a[3]+1, int64(3))
+
+		m3.Insert(a[0], int64(-1))
+		m3.Delete(a[1])
+		m3.Delete(a[2])
+		m3.Insert(a[3]+1, int64(3))
+		for _, m2 := range []*Map{m2, m3} {
+			if Equal(m, m2, valueEq) || Equal(m2, m, valueEq) {
+				t.Fatal("equal")
+			}
+
+			added, removed, changed := Diff(m, m2, valueEq)
+			if g, e := fmt.Sprint(added, sorted(removed), changed), fmt.Sprint([]int64{a[3] + 1}, sorted([]interface{}{a[1], a[2]}), []int64{a[0]}); g != e {
+				t.Fatal(g, e)
+			}
+
+			m5 := m.Clone()
+			Merge(m5, m2, func(k, dv, sv interface{}) interface{} { return dv.(int64) + sv.(int64) })
+			if g, e := m5.Len(), m.Len()+1; g != e {
+				t.Fatal(g, e)
+			}
+
+			for v, key := range a {
+				g, _ := m5.Get(key)
+				switch {
+				case v == 0:
+					if g != int64(-1) {
+						t.Fatal(v, g)
+					}
+				case v == 1 || v == 2:
+					if g != int64(v) {
+						t.Fatal(v, g)
+					}
+				default:
+					if g != int64(2*v) {
+						t.Fatal(v, g)
+					}
+				}
+			}
+		}
+	}
+}
+
+func sorted(a []interface{}) []int64 {
+	var r []int64
+	for _, v := range a {
+		r = append(r, v.(int64))
+	}
+	sort.Slice(r, func(i, j int) bool { return r[i] < r[j] })
+	return r
+}
+
+func TestDigest(t *testing.T) {
+	vh := func(v interface{}) int64 { return fnv(v) }
+	a := rnda(10000)
+	m := New(fnv, cmp, 0)
+	for v, key := range a {
+		m.Insert(key, int64(v))
+	}
+	d := m.Digest(vh)
+	m2 := New(fnv, cmp, 64)
+	m2.Digest(vh)
+	for i := len(a) - 1; i >= 0; i-- {
+		m2.Insert(a[i], int64(-i))
+		m2.Insert(a[i]+1, int64(i))
+		m2.Delete(a[i] + 1)
+	}
+	if m2.Digest(vh) == d {
+		t.Fatal("expected different digests")
+	}
+
+	for c := m2.Cursor(); c.Next(); {
+		c.SetValue(-c.V.(int64))
+	}
+	if g, e := m2.Digest(vh), d; g != e {
+		t.Fatal(g, e)
+	}
+
+	m3 := m2.Clone()
+	m3.Vacuum()
+	m3.ParallelVacuum(2)
+	if g, e := m3.Digest(vh), d; g != e {
+		t.Fatal(g, e)
+	}
+
+	m3.DeleteFunc(func(k, v interface{}) bool { return v.(int64)%2 == 0 })
+	m4 := New(fnv, cmp, 0)
+	for c := m3.Cursor(); c.Next(); {
+		m4.Insert(c.K, c.V)
+	}
+	if g, e := m3.Digest(vh), m4.Digest(vh); g != e || g == d {
+		t.Fatal(g, e)
+	}
+
+	m3.Clear()
+	if g, e := m3.Digest(vh), New(fnv, cmp, 0).Digest(vh); g != e {
+		t.Fatal(g, e)
+	}
+
+	// A different value hash function replaces the maintained digest.
+	vh2 := func(v interface{}) int64 { return ^fnv(v) }
+	m2.Digest(vh)
+	if g, e := m2.Digest(vh2), m.Digest(vh2); g != e || g == d {
+		t.Fatal(g, e)
+	}
+}
+
+func decodeInt64(b []byte) (interface{}, error) {
+	n, i := binary.Varint(b)
+	if i != len(b) {
+		return nil, fmt.Errorf("invalid varint")
+	}
+
+	return n, nil
+}
+
+func appendInt64(b []byte, v interface{}) ([]byte, error) {
+	return binary.AppendVarint(b, v.(int64)), nil
+}
+
+func TestBinary(t *testing.T) {
+	a := rnda(10000)
+	for _, hashes := range []bool{false, true} {
+		c := Codecs{appendInt64, decodeInt64, appendInt64, decodeInt64, hashes}
+		m := New(fnv, cmp, 0)
+		m.SetCodecs(&c)
+		for v, key := range a {
+			m.Insert(key, int64(v))
+		}
+		for _, key := range a[:100] {
+			m.Delete(key)
+		}
+		b, err := m.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		vh := func(v interface{}) int64 { return fnv(v) }
+		m2 := m.NewLike(0)
+		m2.SetCodecs(&c)
+		m2.Digest(vh)
+		if err := m2.UnmarshalBinary(b); err != nil {
+			t.Fatal(hashes, err)
+		}
+
+		if err := m2.Verify(); err != nil {
+			t.Fatal(hashes, err)
+		}
+
+		if !Equal(m, m2, func(a, b interface{}) bool { return a == b }) || m2.Digest(vh) != m.Digest(vh) {
+			t.Fatal(hashes)
+		}
+
+		if g, e := sameLayout(m, m2), hashes; g != e {
+			t.Fatal(hashes, g, e)
+		}
+
+		// Two maps streamed back to back.
+		var buf bytes.Buffer
+		m.WriteTo(&buf)
+		m.Clear()
+		m.Insert(int64(42), int64(314))
+		m.WriteTo(&buf)
+		r := bytes.NewReader(buf.Bytes())
+		if _, err := m2.ReadFrom(r); err != nil || m2.Len() != len(a)-100 {
+			t.Fatal(hashes, err, m2.Len())
+		}
+
+		if n, err := m2.ReadFrom(r); err != nil || n != int64(buf.Len()-len(b)) || m2.Len() != 1 {
+			t.Fatal(hashes, n, err, m2.Len())
+		}
+
+		if v, ok := m2.Get(int64(42)); !ok || v != int64(314) {
+			t.Fatal(hashes, ok, v)
+		}
+
+		m2.Vacuum()
+		if _, err := m2.MarshalBinary(); err != nil {
+			t.Fatal(hashes, err)
+		}
+
+		// Corruption, truncation and trailing data.
+		for i, v := range [][]byte{
+			append([]byte("x"), b[1:]...),
+			append(append(b[:len(b)/2:len(b)/2], b[len(b)/2]^1), b[len(b)/2+1:]...),
+			b[:len(b)-1],
+			b[:len(b)/2],
+			append(b[:len(b):len(b)], 0),
+		} {
+			if err := m2.UnmarshalBinary(v); err == nil {
+				t.Fatal(hashes, i)
+			}
+
+			if m2.Len() != 1 {
+				t.Fatal(hashes, i, m2.Len())
+			}
+		}
+	}
+
+	if _, err := New(fnv, cmp, 0).MarshalBinary(); err == nil {
+		t.Fatal("expected error")
+	}
+
+	// The layout of a sparse map is not encoded.
+	c := Codecs{appendInt64, decodeInt64, appendInt64, decodeInt64, true}
+	m := New(fnv, cmp, 0)
+	m.SetCodecs(&c)
+	for v, key := range a {
+		m.Insert(key, int64(v))
+	}
+	for _, key := range a[10:] {
+		m.Delete(key)
+	}
+	b, err := m.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m2 := m.NewLike(0)
+	m2.SetCodecs(&c)
+	if err := m2.UnmarshalBinary(b); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m2.Verify(); err != nil || !Equal(m, m2, func(a, b interface{}) bool { return a == b }) || sameLayout(m, m2) {
+		t.Fatal(err)
+	}
+
+	// A layout out of proportion to the number of items is rejected.
+	b = append([]byte(binaryMagic), binaryVersion, binaryHashes)
+	b = binary.AppendUvarint(b, 0)     // Items.
+	b = binary.AppendUvarint(b, 1<<20) // Initial number of buckets.
+	b = binary.AppendUvarint(b, 10)    // Level.
+	b = binary.AppendUvarint(b, 0)     // Split pointer.
+	b = binary.LittleEndian.AppendUint32(b, crc32.Checksum(b, crcTable))
+	if err := m2.UnmarshalBinary(b); err == nil || m2.Len() != 10 {
+		t.Fatal(err, m2.Len())
+	}
+
+	// Decoders may retain the slices passed to them.
+	appendBytes := func(b []byte, v interface{}) ([]byte, error) { return append(b, v.([]byte)...), nil }
+	decodeBytes := func(b []byte) (interface{}, error) { return b, nil }
+	for _, hashes := range []bool{false, true} {
+		c := Codecs{appendBytes, decodeBytes, appendBytes, decodeBytes, hashes}
+		m := New(fnvBytes, cmpBytes, 0)
+		m.SetCodecs(&c)
+		for i := 0; i < 100; i++ {
+			m.Insert([]byte(fmt.Sprintf("key%03d", i)), bytes.Repeat([]byte{byte(i)}, i*30))
+		}
+		b, err := m.MarshalBinary()
+		if err != nil {
+			t.Fatal(hashes, err)
+		}
+
+		m2 := m.NewLike(0)
+		m2.SetCodecs(&c)
+		if err := m2.UnmarshalBinary(b); err != nil {
+			t.Fatal(hashes, err)
+		}
+
+		if err := m2.Verify(); err != nil || !Equal(m, m2, func(a, b interface{}) bool { return bytes.Equal(a.([]byte), b.([]byte)) }) {
+			t.Fatal(hashes, err)
+		}
+	}
+}
+
+func TestJSONGob(t *testing.T) {
+	type test struct {
+		m      *Map
+		key    func(int) interface{}
+		newKey func() interface{}
+	}
+	gob.Register(new(big.Int))
+	join := func(k interface{}) []byte { return []byte(strings.Join(k.([]string), "\x00")) }
+	for _, test := range []test{
+		{
+			New(fnvBytes, cmpBytes, 0),
+			func(i int) interface{} { return []byte(fmt.Sprint(i)) },
+			func() interface{} { return new([]byte) },
+		},
+		{
+			New(
+				func(k interface{}) int64 { return fnvBytes(join(k)) },
+				func(a, b interface{}) bool { return bytes.Equal(join(a), join(b)) },
+				0,
+			),
+			func(i int) interface{} { return []string{fmt.Sprint(i), fmt.Sprint(-i)} },
+			func() interface{} { return new([]string) },
+		},
+		{
+			New(
+				func(k interface{}) int64 { return fnvBytes(k.(*big.Int).Bytes()) },
+				func(a, b interface{}) bool { return a.(*big.Int).Cmp(b.(*big.Int)) == 0 },
+				0,
+			),
+			func(i int) interface{} { return big.NewInt(0).Lsh(big.NewInt(int64(i)), 100) },
+			func() interface{} { return new(*big.Int) },
+		},
+	} {
+		m := test.m
+		for i := 0; i < 1000; i++ {
+			m.Insert(test.key(i), fmt.Sprint(i))
+		}
+		m.SetTypes(test.newKey, func() interface{} { return new(string) })
+		valueEq := func(a, b interface{}) bool { return a == b }
+
+		b, err := json.Marshal(m)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		m2 := m.NewLike(0)
+		if err := json.Unmarshal(b, m2); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := m2.Verify(); err != nil || !Equal(m, m2, valueEq) {
+			t.Fatal(err)
+		}
+
+		var buf bytes.Buffer
+		if err := gob.NewEncoder(&buf).Encode(m); err != nil {
+			t.Fatal(err)
+		}
+
+		m2 = m.NewLike(0)
+		if err := gob.NewDecoder(&buf).Decode(m2); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := m2.Verify(); err != nil || !Equal(m, m2, valueEq) {
+			t.Fatal(err)
+		}
+	}
+
+	m := New(fnv, cmp, 0)
+	m.SetTypes(func() interface{} { return new(int64) }, nil)
+	if err := m.UnmarshalJSON([]byte(`[{"k":1,"v":2},{"k":1,"v":3}]`)); err == nil || m.Len() != 0 {
+		t.Fatal(err, m.Len())
+	}
+
+	if err := m.GobDecode(nil); err == nil {
+		t.Fatal("expected error")
+	}
+
+	// Nil keys mark empty slots, they are rejected.
+	m = New(fnvBytes, cmpBytes, 0)
+	if err := m.UnmarshalJSON([]byte(`[{"k":null,"v":1},{"k":"x","v":2}]`)); err == nil || m.Len() != 0 {
+		t.Fatal(err, m.Len())
+	}
+
+	var buf bytes.Buffer
+	enc := gob.NewEncoder(&buf)
+	for _, v := range []interface{}{2, gobItem{nil, 1}, gobItem{"x", 2}} {
+		if err := enc.Encode(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := m.GobDecode(buf.Bytes()); err == nil || m.Len() != 0 {
+		t.Fatal(err, m.Len())
+	}
+}
+
+func TestGob(t *testing.T) {
+	m := New(fnvBytes, cmpBytes, 0)
+	for i := 0; i < 1000; i++ {
+		var v interface{}
+		if i%3 != 0 {
+			v = fmt.Sprint(i)
+		}
+		m.Insert([]byte(fmt.Sprint(i)), v)
+	}
+
+	b, err := m.GobEncode()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// No SetTypes, the items carry their types.
+	m2 := m.NewLike(0)
+	if err := m2.GobDecode(b); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m2.Verify(); err != nil || !Equal(m, m2, func(a, b interface{}) bool { return a == b }) {
+		t.Fatal(err)
+	}
+
+	if v, ok := m2.Get([]byte("3")); !ok || v != nil {
+		t.Fatal(v, ok)
+	}
+}
+
+func TestMmap(t *testing.T) {
+	dir := t.TempDir()
+	build := func(name string, m *Map) string {
+		name = filepath.Join(dir, name)
+		f, err := os.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := Build(f, m.Cursor()); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := f.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		return name
+	}
+
+	const n = 10000
+	m := New(fnvBytes, cmpBytes, 0)
+	for i := 0; i < n; i++ {
+		m.Insert([]byte(fmt.Sprint(i)), []byte(fmt.Sprint(-i)))
+	}
+	m.Insert([]byte("nil"), nil)
+	name := build("a", m)
+	mm, err := OpenMmap(name, fnvBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if g, e := mm.Len(), n+1; g != e {
+		t.Fatal(g, e)
+	}
+
+	for i := 0; i < n; i++ {
+		if v, ok := mm.Get([]byte(fmt.Sprint(i))); !ok || string(v) != fmt.Sprint(-i) {
+			t.Fatal(i, ok, v)
+		}
+
+		if v, ok := mm.Get([]byte(fmt.Sprint(-i - 1))); ok {
+			t.Fatal(i, v)
+		}
+	}
+	if v, ok := mm.Get([]byte("nil")); !ok || len(v) != 0 {
+		t.Fatal(ok, v)
+	}
+
+	if err := mm.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := OpenMmap(name, func(k interface{}) int64 { return fnvBytes(k) + 1 }); err == nil {
+		t.Fatal("expected error")
+	}
+
+	b, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, v := range [][]byte{b[:len(b)-1], b[:32], b[:40]} {
+		if err := os.WriteFile(name, v, 0666); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := OpenMmap(name, fnvBytes); err == nil {
+			t.Fatal(len(v))
+		}
+	}
+
+	if mm, err = OpenMmap(build("b", New(fnvBytes, cmpBytes, 0)), fnvBytes); err != nil {
+		t.Fatal(err)
+	}
+
+	if v, ok := mm.Get([]byte("foo")); ok || mm.Len() != 0 {
+		t.Fatal(v, ok, mm.Len())
+	}
+
+	mm.Close()
+	m = New(fnv, cmp, 0)
+	m.Insert(int64(42), nil)
+	if err := Build(io.Discard, m.Cursor()); err == nil {
+		t.Fatal("expected error")
+	}
+
+	c := m.Cursor()
+	for c.Next() {
+	}
+	if err := Build(io.Discard, c); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestDurable(t *testing.T) {
+	dir := t.TempDir()
+	open := func(opts *DurableOptions) *DurableMap {
+		m := New(fnv, cmp, 0)
+		m.SetCodecs(&Codecs{appendInt64, decodeInt64, appendInt64, decodeInt64, false})
+		d, err := OpenDurable(dir, m, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return d
+	}
+	check := func(d *DurableMap, n int, present func(int) bool) {
+		t.Helper()
+		cnt := 0
+		for i := 0; i < n; i++ {
+			v, ok := d.Get(int64(i))
+			if ok != present(i) || ok && v != int64(-i) {
+				t.Fatal(i, ok, v)
+			}
+
+			if ok {
+				cnt++
+			}
+		}
+		if g, e := d.Len(), cnt; g != e {
+			t.Fatal(g, e)
+		}
+	}
+	wal := filepath.Join(dir, walName)
+
+	const n = 1000
+	d := open(nil)
+	for i := 0; i < n; i++ {
+		if err := d.Insert(int64(i), int64(i)); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := d.Insert(int64(i), int64(-i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < n; i += 3 {
+		if err := d.Delete(int64(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	check(d, n, func(i int) bool { return i%3 != 0 })
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	d = open(nil)
+	check(d, n, func(i int) bool { return i%3 != 0 })
+	if err := d.Checkpoint(); err != nil {
+		t.Fatal(err)
+	}
+
+	if fi, err := os.Stat(wal); err != nil || fi.Size() != 0 {
+		t.Fatal(err, fi.Size())
+	}
+
+	for i := 0; i < n; i += 3 {
+		if err := d.Insert(int64(i), int64(-i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	d.Close()
+	b, err := os.ReadFile(wal)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A truncated last record is dropped.
+	if err := os.WriteFile(wal, b[:len(b)-1], 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	last := (n - 1) / 3 * 3
+	d = open(nil)
+	check(d, n, func(i int) bool { return i != last })
+	d.Close()
+	if fi, err := os.Stat(wal); err != nil || fi.Size() >= int64(len(b)) {
+		t.Fatal(err, fi.Size(), len(b))
+	}
+
+	// A last record with a checksum mismatch is dropped.
+	b[len(b)-1] ^= 1
+	if err := os.WriteFile(wal, b, 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	d = open(nil)
+	check(d, n, func(i int) bool { return i != last })
+	d.Close()
+	b[len(b)-1] ^= 1
+
+	// A checksum mismatch of a record followed by other records is an
+	// error and the log is kept.
+	b[len(b)/2] ^= 1
+	if err := os.WriteFile(wal, b, 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	m := New(fnv, cmp, 0)
+	m.SetCodecs(&Codecs{appendInt64, decodeInt64, appendInt64, decodeInt64, false})
+	if _, err := OpenDurable(dir, m, nil); err == nil {
+		t.Fatal("unexpected success")
+	}
+
+	if fi, err := os.Stat(wal); err != nil || fi.Size() != int64(len(b)) {
+		t.Fatal(err, fi.Size(), len(b))
+	}
+
+	b[len(b)/2] ^= 1
+	if err := os.WriteFile(wal, b, 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	d = open(nil)
+	check(d, n, func(int) bool { return true })
+
+	// Automatic checkpoints; replaying a log over a snapshot already
+	// containing its records is harmless.
+	d.Close()
+	d = open(&DurableOptions{CheckpointSize: 1000, SyncWrites: true})
+	for i := 0; i < n; i += 3 {
+		if err := d.Insert(int64(i), int64(-i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	check(d, n, func(int) bool { return true })
+	if fi, err := os.Stat(wal); err != nil || fi.Size() >= 1000 {
+		t.Fatal(err, fi.Size())
+	}
+
+	if err := d.Checkpoint(); err != nil {
+		t.Fatal(err)
+	}
+
+	d.Close()
+	if err := os.WriteFile(wal, b, 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	d = open(nil)
+	check(d, n, func(int) bool { return true })
+	d.Close()
+
+	// Decoders may retain the slices passed to them.
+	dir = t.TempDir()
+	appendBytes := func(b []byte, v interface{}) ([]byte, error) { return append(b, v.([]byte)...), nil }
+	decodeBytes := func(b []byte) (interface{}, error) { return b, nil }
+	openBytes := func() *DurableMap {
+		m := New(fnvBytes, cmpBytes, 0)
+		m.SetCodecs(&Codecs{appendBytes, decodeBytes, appendBytes, decodeBytes, false})
+		d, err := OpenDurable(dir, m, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return d
+	}
+	d = openBytes()
+	for i := 0; i < 100; i++ {
+		if err := d.Insert([]byte(fmt.Sprintf("key%03d", i)), []byte(fmt.Sprint(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	d.Close()
+	d = openBytes()
+	for i := 0; i < 100; i++ {
+		if v, ok := d.Get([]byte(fmt.Sprintf("key%03d", i))); !ok || string(v.([]byte)) != fmt.Sprint(i) {
+			t.Fatal(i, ok, v)
+		}
+	}
+	if g, e := d.Len(), 100; g != e {
+		t.Fatal(g, e)
+	}
+
+	d.Close()
+}
+
+func TestFreeze(t *testing.T) {
+	for _, sz := range []int{0, 1, 2, 5, 100, 100000} {
+		a := rnda(2 * sz)
+		m := New(fnv, cmp, 0)
+		for v, key := range a[:sz] {
+			m.Insert(key, int64(v))
+		}
+		f, err := m.Freeze()
+		if err != nil {
+			t.Fatal(sz, err)
+		}
+
+		if g, e := f.Len(), sz; g != e {
+			t.Fatal(sz, g, e)
+		}
+
+		for v, key := range a[:sz] {
+			if g, ok := f.Get(key); !ok || g != int64(v) {
+				t.Fatal(sz, ok, g, v)
+			}
+
+			if g := f.GetMember(key); g != int64(v) {
+				t.Fatal(sz, g, v)
+			}
+		}
+		for _, key := range a[sz:] {
+			if g, ok := f.Get(key); ok {
+				t.Fatal(sz, g)
+			}
+		}
+	}
+
+	m := New(func(interface{}) int64 { return 42 }, cmp, 0)
+	m.Insert(int64(1), nil)
+	m.Insert(int64(2), nil)
+	if _, err := m.Freeze(); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func testFlatMap(t *testing.T, m *FlatMap, a []int64) {
+	e := map[int64]int64{}
+	check := func() {
+		if g, e := m.Len(), len(e); g != e {
+			t.Fatal(g, e)
+		}
+
+		n := 0
+		m.Range(func(k, v interface{}) bool {
+			if g, ok := e[k.(int64)]; !ok || g != v.(int64) {
+				t.Fatal(k, v, g, ok)
+			}
+
+			n++
+			return true
+		})
+		if g, e := n, len(e); g != e {
+			t.Fatal(g, e)
+		}
+
+		for _, k := range a {
+			g, ok := m.Get(k)
+			if v, ok2 := e[k]; ok != ok2 || ok && g != v {
+				t.Fatal(k, g, ok, v, ok2)
+			}
+		}
+	}
+
+	sz := len(a) / 2
+	for v, k := range a[:sz] {
+		m.Insert(k, int64(v))
+		e[k] = int64(v)
+	}
+	check()
+
+	for v, k := range a[:sz] {
+		if v%2 == 0 {
+			m.Delete(k)
+			delete(e, k)
+			continue
+		}
+
+		m.Insert(k, -int64(v))
+		e[k] = -int64(v)
+	}
+	if len(a) != 0 {
+		m.Delete(a[len(a)-1]) // Not in m.
+	}
+	check()
+
+	// Churn the table, leaving deleted slots behind.
+	for i, k := range a[sz:] {
+		m.Insert(k, int64(i))
+		e[k] = int64(i)
+		m.Delete(a[i])
+		delete(e, a[i])
+	}
+	check()
+
+	m.Clear()
+	e = map[int64]int64{}
+	check()
+}
+
+func TestFlatMap(t *testing.T) {
+	for _, sz := range []int{0, 1, 7, 8, 100, 100000} {
+		testFlatMap(t, NewFlat(fnv, cmp, 0), rnda(2*sz))
+		testFlatMap(t, NewFlat(fnv, cmp, sz), rnda(2*sz))
+	}
+
+	// All keys have the same control byte and probe sequence.
+	testFlatMap(t, NewFlat(func(interface{}) int64 { return 42 }, cmp, 0), rnda(200))
+
+	m := NewFlat(fnv, cmp, 0)
+	m.Grow(1000)
+	n := len(m.items)
+	for v, k := range rnda(1000) {
+		m.Insert(k, int64(v))
+	}
+	if g, e := len(m.items), n; g != e {
+		t.Fatal(g, e)
+	}
+}
+
 func benchmarkGet(b *testing.B, sz int) {
 	a := rnda(sz)
 	m := New(fnv, cmp, 0)
@@ -305,7 +1761,52 @@ func benchmarkGet(b *testing.B, sz int) {
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
 		for v, k := range a {
-			g, ok := m.Get(k)
+			g, ok := m.Get(k)
+			if !ok || g != int64(v) {
+				b.Fatal(ok, g, v)
+			}
+		}
+	}
+	b.StopTimer()
+}
+
+func BenchmarkGet(b *testing.B) {
+	var n int
+	for _, e := range []int{3, 4, 5, 6} {
+		if *exp > 0 && *exp != e {
+			continue
+		}
+
+		n = 1
+		for i := 0; i < e; i++ {
+			n *= 10
+		}
+		b.Run(fmt.Sprintf("1e%d", e), func(b *testing.B) { benchmarkGet(b, n) })
+	}
+}
+
+func benchmarkFrozenGet(b *testing.B, sz int, member bool) {
+	a := rnda(sz)
+	m := New(fnv, cmp, 0)
+	for v, k := range a {
+		m.Insert(k, int64(v))
+	}
+	f, err := m.Freeze()
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for v, k := range a {
+			var g interface{}
+			ok := true
+			switch {
+			case member:
+				g = f.GetMember(k)
+			default:
+				g, ok = f.Get(k)
+			}
 			if !ok || g != int64(v) {
 				b.Fatal(ok, g, v)
 			}
@@ -314,7 +1815,7 @@ func benchmarkGet(b *testing.B, sz int) {
 	b.StopTimer()
 }
 
-func BenchmarkGet(b *testing.B) {
+func BenchmarkFrozenGet(b *testing.B) {
 	var n int
 	for _, e := range []int{3, 4, 5, 6} {
 		if *exp > 0 && *exp != e {
@@ -325,7 +1826,42 @@ func BenchmarkGet(b *testing.B) {
 		for i := 0; i < e; i++ {
 			n *= 10
 		}
-		b.Run(fmt.Sprintf("1e%d", e), func(b *testing.B) { benchmarkGet(b, n) })
+		b.Run(fmt.Sprintf("1e%d", e), func(b *testing.B) { benchmarkFrozenGet(b, n, false) })
+		b.Run(fmt.Sprintf("member/1e%d", e), func(b *testing.B) { benchmarkFrozenGet(b, n, true) })
+	}
+}
+
+func benchmarkGetBatch(b *testing.B, sz int) {
+	a := rnda(sz)
+	m := New(fnv, cmp, 0)
+	keys := make([]interface{}, len(a))
+	for v, k := range a {
+		m.Insert(k, int64(v))
+		keys[v] = k
+	}
+	values := make([]interface{}, len(a))
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if g, e := m.GetBatch(keys, values), len(a); g != e {
+			b.Fatal(g, e)
+		}
+	}
+	b.StopTimer()
+}
+
+func BenchmarkGetBatch(b *testing.B) {
+	var n int
+	for _, e := range []int{3, 4, 5, 6} {
+		if *exp > 0 && *exp != e {
+			continue
+		}
+
+		n = 1
+		for i := 0; i < e; i++ {
+			n *= 10
+		}
+		b.Run(fmt.Sprintf("1e%d", e), func(b *testing.B) { benchmarkGetBatch(b, n) })
 	}
 }
 
@@ -356,6 +1892,37 @@ func BenchmarkInsert(b *testing.B) {
 	}
 }
 
+func benchmarkInsertBatch(b *testing.B, sz int) {
+	a := rnda(sz)
+	keys := make([]interface{}, len(a))
+	values := make([]interface{}, len(a))
+	for v, k := range a {
+		keys[v] = k
+		values[v] = int64(v)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		m := New(fnv, cmp, 0)
+		m.InsertBatch(keys, values)
+	}
+	b.StopTimer()
+}
+
+func BenchmarkInsertBatch(b *testing.B) {
+	var n int
+	for _, e := range []int{3, 4, 5, 6} {
+		if *exp > 0 && *exp != e {
+			continue
+		}
+
+		n = 1
+		for i := 0; i < e; i++ {
+			n *= 10
+		}
+		b.Run(fmt.Sprintf("1e%d", e), func(b *testing.B) { benchmarkInsertBatch(b, n) })
+	}
+}
+
 func benchmarkDelete(b *testing.B, sz int) {
 	a := rnda(sz)
 	m := New(fnv, cmp, 0)
@@ -391,3 +1958,246 @@ func BenchmarkDelete(b *testing.B) {
 		b.Run(fmt.Sprintf("1e%d", e), func(b *testing.B) { benchmarkDelete(b, n) })
 	}
 }
+
+func benchmarkMarshalBinary(b *testing.B, sz int, unmarshal bool) {
+	a := rnda(sz)
+	m := New(fnv, cmp, 0)
+	m.SetCodecs(&Codecs{appendInt64, decodeInt64, appendInt64, decodeInt64, true})
+	for v, k := range a {
+		m.Insert(k, int64(v))
+	}
+	data, err := m.MarshalBinary()
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	m2 := m.NewLike(0)
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		switch {
+		case unmarshal:
+			err = m2.UnmarshalBinary(data)
+		default:
+			_, err = m.MarshalBinary()
+		}
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.StopTimer()
+}
+
+func BenchmarkMarshalBinary(b *testing.B) {
+	var n int
+	for _, e := range []int{3, 4, 5, 6} {
+		if *exp > 0 && *exp != e {
+			continue
+		}
+
+		n = 1
+		for i := 0; i < e; i++ {
+			n *= 10
+		}
+		b.Run(fmt.Sprintf("1e%d", e), func(b *testing.B) { benchmarkMarshalBinary(b, n, false) })
+		b.Run(fmt.Sprintf("unmarshal/1e%d", e), func(b *testing.B) { benchmarkMarshalBinary(b, n, true) })
+	}
+}
+
+// The FlatMap and Builtin benchmarks mirror the Get, Insert and Delete
+// benchmarks of Map. The builtin map has int64 keys and is thus not subject to
+// the cost of the hash and eq functions.
+
+func benchmarkFlatGet(b *testing.B, sz int) {
+	a := rnda(sz)
+	m := NewFlat(fnv, cmp, 0)
+	for v, k := range a {
+		m.Insert(k, int64(v))
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for v, k := range a {
+			g, ok := m.Get(k)
+			if !ok || g != int64(v) {
+				b.Fatal(ok, g, v)
+			}
+		}
+	}
+	b.StopTimer()
+}
+
+func BenchmarkFlatGet(b *testing.B) {
+	var n int
+	for _, e := range []int{3, 4, 5, 6} {
+		if *exp > 0 && *exp != e {
+			continue
+		}
+
+		n = 1
+		for i := 0; i < e; i++ {
+			n *= 10
+		}
+		b.Run(fmt.Sprintf("1e%d", e), func(b *testing.B) { benchmarkFlatGet(b, n) })
+	}
+}
+
+func benchmarkFlatInsert(b *testing.B, sz int) {
+	a := rnda(sz)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		m := NewFlat(fnv, cmp, 0)
+		for v, k := range a {
+			m.Insert(k, int64(v))
+		}
+	}
+	b.StopTimer()
+}
+
+func BenchmarkFlatInsert(b *testing.B) {
+	var n int
+	for _, e := range []int{3, 4, 5, 6} {
+		if *exp > 0 && *exp != e {
+			continue
+		}
+
+		n = 1
+		for i := 0; i < e; i++ {
+			n *= 10
+		}
+		b.Run(fmt.Sprintf("1e%d", e), func(b *testing.B) { benchmarkFlatInsert(b, n) })
+	}
+}
+
+func benchmarkFlatDelete(b *testing.B, sz int) {
+	a := rnda(sz)
+	m := NewFlat(fnv, cmp, 0)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		if m.Len() != 0 {
+			b.Fatal(m.Len())
+		}
+
+		for v, k := range a {
+			m.Insert(k, int64(v))
+		}
+		b.StartTimer()
+		for _, k := range a {
+			m.Delete(k)
+		}
+	}
+	b.StopTimer()
+}
+
+func BenchmarkFlatDelete(b *testing.B) {
+	var n int
+	for _, e := range []int{3, 4, 5, 6} {
+		if *exp > 0 && *exp != e {
+			continue
+		}
+
+		n = 1
+		for i := 0; i < e; i++ {
+			n *= 10
+		}
+		b.Run(fmt.Sprintf("1e%d", e), func(b *testing.B) { benchmarkFlatDelete(b, n) })
+	}
+}
+
+func benchmarkBuiltinGet(b *testing.B, sz int) {
+	a := rnda(sz)
+	m := map[int64]interface{}{}
+	for v, k := range a {
+		m[k] = int64(v)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for v, k := range a {
+			g, ok := m[k]
+			if !ok || g != int64(v) {
+				b.Fatal(ok, g, v)
+			}
+		}
+	}
+	b.StopTimer()
+}
+
+func BenchmarkBuiltinGet(b *testing.B) {
+	var n int
+	for _, e := range []int{3, 4, 5, 6} {
+		if *exp > 0 && *exp != e {
+			continue
+		}
+
+		n = 1
+		for i := 0; i < e; i++ {
+			n *= 10
+		}
+		b.Run(fmt.Sprintf("1e%d", e), func(b *testing.B) { benchmarkBuiltinGet(b, n) })
+	}
+}
+
+func benchmarkBuiltinInsert(b *testing.B, sz int) {
+	a := rnda(sz)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		m := map[int64]interface{}{}
+		for v, k := range a {
+			m[k] = int64(v)
+		}
+	}
+	b.StopTimer()
+}
+
+func BenchmarkBuiltinInsert(b *testing.B) {
+	var n int
+	for _, e := range []int{3, 4, 5, 6} {
+		if *exp > 0 && *exp != e {
+			continue
+		}
+
+		n = 1
+		for i := 0; i < e; i++ {
+			n *= 10
+		}
+		b.Run(fmt.Sprintf("1e%d", e), func(b *testing.B) { benchmarkBuiltinInsert(b, n) })
+	}
+}
+
+func benchmarkBuiltinDelete(b *testing.B, sz int) {
+	a := rnda(sz)
+	m := map[int64]interface{}{}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		if len(m) != 0 {
+			b.Fatal(len(m))
+		}
+
+		for v, k := range a {
+			m[k] = int64(v)
+		}
+		b.StartTimer()
+		for _, k := range a {
+			delete(m, k)
+		}
+	}
+	b.StopTimer()
+}
+
+func BenchmarkBuiltinDelete(b *testing.B) {
+	var n int
+	for _, e := range []int{3, 4, 5, 6} {
+		if *exp > 0 && *exp != e {
+			continue
+		}
+
+		n = 1
+		for i := 0; i < e; i++ {
+			n *= 10
+		}
+		b.Run(fmt.Sprintf("1e%d", e), func(b *testing.B) { benchmarkBuiltinDelete(b, n) })
+	}
+}
@@ -0,0 +1,99 @@
+// Copyright 2017 The hash Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestReadKeys(t *testing.T) {
+	keys, err := readKeys(strings.NewReader("a\nb\n\nc"), "lines", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if g, e := fmt.Sprintf("%q", keys), `["a" "b" "" "c"]`; g != e {
+		t.Fatal(g, e)
+	}
+
+	if keys, err = readKeys(strings.NewReader("{\"a\": 1}\n\n[1, 2]\n"), "ndjson", 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if g, e := fmt.Sprintf("%q", keys), `["{\"a\":1}" "[1,2]"]`; g != e {
+		t.Fatal(g, e)
+	}
+
+	if _, err = readKeys(strings.NewReader("{"), "ndjson", 0); err == nil {
+		t.Fatal("expected error")
+	}
+
+	if keys, err = readKeys(strings.NewReader("abcdef"), "binary", 2); err != nil {
+		t.Fatal(err)
+	}
+
+	if g, e := fmt.Sprintf("%q", keys), `["ab" "cd" "ef"]`; g != e {
+		t.Fatal(g, e)
+	}
+
+	var b []byte
+	for _, s := range []string{"foo", "", "barbaz"} {
+		b = binary.AppendUvarint(b, uint64(len(s)))
+		b = append(b, s...)
+	}
+	if keys, err = readKeys(bytes.NewReader(b), "binary", 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if g, e := fmt.Sprintf("%q", keys), `["foo" "" "barbaz"]`; g != e {
+		t.Fatal(g, e)
+	}
+
+	for _, n := range []uint64{maxKey + 1, 1 << 62, maxKey} {
+		b = binary.AppendUvarint(b, n)
+		if _, err = readKeys(bytes.NewReader(b), "binary", 0); err == nil {
+			t.Fatal(n)
+		}
+
+		b = b[:len(b)-binary.PutUvarint(make([]byte, binary.MaxVarintLen64), n)]
+	}
+}
+
+func TestReport(t *testing.T) {
+	var keys [][]byte
+	for i := 0; i < 10000; i++ {
+		keys = append(keys, []byte(fmt.Sprint(i%5000)))
+	}
+	keys = unique(keys)
+	if g, e := len(keys), 5000; g != e {
+		t.Fatal(g, e)
+	}
+
+	hs, err := hashers("all")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, h := range hs {
+		// FNV is known to have a poor avalanche behaviour.
+		if mean, worst := avalanche(h.hash, keys, 100); h.name != "fnv" && (mean < 0.45 || mean > 0.55 || worst > 0.1) {
+			t.Errorf("%s: avalanche mean %v, worst %v", h.name, mean, worst)
+		}
+
+		var b bytes.Buffer
+		report(&b, h, keys, 100)
+		if !strings.Contains(b.String(), "64 bit collisions: 0") {
+			t.Errorf("%s:\n%s", h.name, b.String())
+		}
+	}
+
+	if _, err := hashers("foo"); err == nil {
+		t.Fatal("expected error")
+	}
+}
@@ -0,0 +1,327 @@
+// Copyright 2017 The hash Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Command hashcheck analyzes the quality of hash functions for a sample of
+// keys.
+//
+// Usage
+//
+//	hashcheck [flags] [file]
+//
+// The keys are read from file, or from stdin if no file is given. Flags:
+//
+//	-format lines|ndjson|binary
+//		How to split the input into keys. 'lines' uses every line as a
+//		key. 'ndjson' uses every line, which must be a JSON value, as a
+//		key, insignificant white space is removed. 'binary' reads
+//		records of -recsize bytes or, if -recsize is zero, records
+//		prefixed by their length encoded as an unsigned varint.
+//	-hash fnv|maphash|siphash|all
+//		The hash function(s) to analyze.
+//	-avalanche n
+//		Number of keys used for the avalanche test.
+//
+// For every hash function hashcheck reports
+//
+//   - the number of 64 bit hash collisions between distinct keys,
+//   - the avalanche behaviour, ie. the probability an output bit changes when
+//     a single input bit is flipped, which should be close to 0.5,
+//   - the distribution of keys into buckets for every level of a Map, ie.
+//     for the lowest 1, 2, ... bits of the hash,
+//   - the shape of a Map created by inserting all the keys.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"hash/maphash"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"text/tabwriter"
+
+	"github.com/cznic/hash"
+	"github.com/cznic/hash/hashfn"
+)
+
+var (
+	oAvalanche = flag.Int("avalanche", 1000, "number of keys used for the avalanche test")
+	oFormat    = flag.String("format", "lines", "input format: lines, ndjson or binary")
+	oHash      = flag.String("hash", "all", "hash function: fnv, maphash, siphash or all")
+	oRecSize   = flag.Int("recsize", 0, "binary record size, zero for varint length prefixed records")
+)
+
+const maxKey = 1 << 30 // Maximum size of a key read from the input.
+
+type hasher struct {
+	name string
+	hash func(k []byte) uint64
+}
+
+func hashers(name string) ([]hasher, error) {
+	seed := maphash.MakeSeed()
+	all := []hasher{
+		{"fnv", func(k []byte) uint64 { return uint64(hashfn.Bytes(k)) }},
+		{"maphash", func(k []byte) uint64 { return maphash.Bytes(seed, k) }},
+		{"siphash", func(k []byte) uint64 { return hashfn.SipHash(0x0706050403020100, 0x0f0e0d0c0b0a0908, k) }},
+	}
+	if name == "all" {
+		return all, nil
+	}
+
+	for _, v := range all {
+		if v.name == name {
+			return []hasher{v}, nil
+		}
+	}
+
+	return nil, fmt.Errorf("unknown hash function: %s", name)
+}
+
+func main() {
+	flag.Parse()
+	if err := main1(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func main1() error {
+	hs, err := hashers(*oHash)
+	if err != nil {
+		return err
+	}
+
+	var r io.Reader = os.Stdin
+	switch flag.NArg() {
+	case 0:
+		// nop
+	case 1:
+		f, err := os.Open(flag.Arg(0))
+		if err != nil {
+			return err
+		}
+
+		defer f.Close()
+
+		r = f
+	default:
+		return fmt.Errorf("at most one input file expected")
+	}
+
+	keys, err := readKeys(r, *oFormat, *oRecSize)
+	if err != nil {
+		return err
+	}
+
+	keys = unique(keys)
+	if len(keys) == 0 {
+		return fmt.Errorf("no keys")
+	}
+
+	w := bufio.NewWriter(os.Stdout)
+	fmt.Fprintf(w, "%d distinct keys\n", len(keys))
+	for _, h := range hs {
+		report(w, h, keys, *oAvalanche)
+	}
+	return w.Flush()
+}
+
+func readKeys(r io.Reader, format string, recSize int) (keys [][]byte, err error) {
+	switch format {
+	case "lines", "ndjson":
+		s := bufio.NewScanner(r)
+		s.Buffer(nil, maxKey)
+		for line := 1; s.Scan(); line++ {
+			k := append([]byte(nil), s.Bytes()...)
+			if format == "ndjson" {
+				if len(bytes.TrimSpace(k)) == 0 {
+					continue
+				}
+
+				var b bytes.Buffer
+				if err := json.Compact(&b, k); err != nil {
+					return nil, fmt.Errorf("line %d: %v", line, err)
+				}
+
+				k = b.Bytes()
+			}
+			keys = append(keys, k)
+		}
+		return keys, s.Err()
+	case "binary":
+		br := bufio.NewReader(r)
+		for {
+			n := recSize
+			if n == 0 {
+				u, err := binary.ReadUvarint(br)
+				if err != nil {
+					if err == io.EOF {
+						return keys, nil
+					}
+
+					return nil, err
+				}
+
+				if u > maxKey {
+					return nil, fmt.Errorf("record %d: key size %d exceeds %d", len(keys), u, maxKey)
+				}
+
+				n = int(u)
+			}
+
+			// The key is read without preallocating n bytes, a malformed
+			// size does not allocate more than the input holds.
+			k, err := io.ReadAll(io.LimitReader(br, int64(n)))
+			if err != nil {
+				return nil, fmt.Errorf("record %d: %v", len(keys), err)
+			}
+
+			if len(k) < n {
+				if len(k) == 0 && recSize != 0 {
+					return keys, nil
+				}
+
+				return nil, fmt.Errorf("record %d: %v", len(keys), io.ErrUnexpectedEOF)
+			}
+
+			keys = append(keys, k)
+		}
+	default:
+		return nil, fmt.Errorf("unknown input format: %s", format)
+	}
+}
+
+func unique(keys [][]byte) [][]byte {
+	m := map[string]struct{}{}
+	w := 0
+	for _, k := range keys {
+		if _, ok := m[string(k)]; ok {
+			continue
+		}
+
+		m[string(k)] = struct{}{}
+		keys[w] = k
+		w++
+	}
+	return keys[:w]
+}
+
+// collisions returns the number of keys having the same 64 bit hash as some
+// other, distinct key.
+func collisions(hs []uint64) (r int) {
+	a := append([]uint64(nil), hs...)
+	sort.Slice(a, func(i, j int) bool { return a[i] < a[j] })
+	for i := 1; i < len(a); i++ {
+		if a[i] == a[i-1] {
+			r++
+		}
+	}
+	return r
+}
+
+// avalanche flips every input bit of the first n keys and returns the mean
+// probability of an output bit change and the maximum deviation of any
+// output bit change probability from the ideal 0.5.
+func avalanche(hash func([]byte) uint64, keys [][]byte, n int) (mean, worst float64) {
+	var flips [64]int
+	tests := 0
+	for _, k := range keys[:min(n, len(keys))] {
+		h := hash(k)
+		k = append([]byte(nil), k...)
+		for i := 0; i < 8*len(k); i++ {
+			k[i/8] ^= 1 << uint(i%8)
+			d := h ^ hash(k)
+			k[i/8] ^= 1 << uint(i%8)
+			for j := range flips {
+				flips[j] += int(d >> uint(j) & 1)
+			}
+			tests++
+		}
+	}
+	if tests == 0 {
+		return 0, 0
+	}
+
+	for _, v := range flips {
+		p := float64(v) / float64(tests)
+		mean += p
+		worst = math.Max(worst, math.Abs(p-0.5))
+	}
+	return mean / 64, worst
+}
+
+type level struct {
+	bits    int
+	empty   int
+	max     int
+	chiSq   float64 // Chi-squared statistic of the bucket loads.
+	chiSqDf int     // Degrees of freedom of chiSq.
+}
+
+// levels returns the distribution of hashes into buckets addressed by the
+// lowest 1, 2, ... bits, while the expected bucket load is at least one.
+func levels(hs []uint64) (r []level) {
+	for b := 1; b < 63 && 1<<uint(b) <= len(hs); b++ {
+		n := 1 << uint(b)
+		loads := make([]int, n)
+		for _, h := range hs {
+			loads[h&uint64(n-1)]++
+		}
+		l := level{bits: b, chiSqDf: n - 1}
+		e := float64(len(hs)) / float64(n)
+		for _, v := range loads {
+			if v == 0 {
+				l.empty++
+			}
+			l.max = max(l.max, v)
+			d := float64(v) - e
+			l.chiSq += d * d / e
+		}
+		r = append(r, l)
+	}
+	return r
+}
+
+func report(w io.Writer, h hasher, keys [][]byte, n int) {
+	hs := make([]uint64, len(keys))
+	for i, k := range keys {
+		hs[i] = h.hash(k)
+	}
+
+	fmt.Fprintf(w, "\n== %s\n", h.name)
+	fmt.Fprintf(w, "64 bit collisions: %d\n", collisions(hs))
+	mean, worst := avalanche(h.hash, keys, n)
+	fmt.Fprintf(w, "avalanche: mean %.4f, worst bias %.4f\n", mean, worst)
+
+	tw := tabwriter.NewWriter(w, 0, 8, 1, ' ', tabwriter.AlignRight)
+	fmt.Fprintf(tw, "bits\tbuckets\tempty\tmax load\tchi^2/df\t\n")
+	for _, l := range levels(hs) {
+		fmt.Fprintf(tw, "%d\t%d\t%d\t%d\t%.3f\t\n", l.bits, 1<<uint(l.bits), l.empty, l.max, l.chiSq/float64(l.chiSqDf))
+	}
+	tw.Flush()
+
+	m := hash.New(
+		func(k interface{}) int64 { return int64(h.hash(k.([]byte))) },
+		func(a, b interface{}) bool { return bytes.Equal(a.([]byte), b.([]byte)) },
+		0,
+	)
+	for _, k := range keys {
+		m.Insert(k, nil)
+	}
+	s := m.Stats()
+	fmt.Fprintf(w, "map: %d buckets, level %d, split pointer %d, %d splits, %d empty buckets, max chain %d\n",
+		s.Buckets, s.Level, s.Split, s.Buckets-s.InitialBuckets, s.EmptyBuckets, s.MaxChain)
+	fmt.Fprintf(w, "map: probes per hit %.3f, probes per miss %.3f, %d bytes\n", s.ProbesHit, s.ProbesMiss, s.Bytes)
+	fmt.Fprintf(w, "map: chain length histogram")
+	for i, v := range s.Histogram {
+		fmt.Fprintf(w, " %d:%d", i, v)
+	}
+	fmt.Fprintln(w)
+}
@@ -0,0 +1,104 @@
+// Copyright 2017 The hash Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"go/parser"
+	"go/token"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReplace(t *testing.T) {
+	for i, v := range []struct{ src, out, hash, eq string }{
+		{
+			"package p\n\nfunc f(k interface{} /*K*/, v interface{} /*V*/) []interface{} /*K*/ { var x interface{}; return nil }\n",
+			"package p\n\nfunc f(k *big.Int, v string) []*big.Int { var x interface{}; return nil }\n",
+			"", "",
+		},
+		{
+			"package p\n\ntype t struct {\n\tk interface{} /*K*/\n\tv interface{}\t/*V*/\n}\n",
+			"package p\n\ntype t struct {\n\tk *big.Int\n\tv string\n}\n",
+			"", "",
+		},
+		{"package p\n\nvar x int /*K*/\n", "", "", ""},
+		{
+			"package p\n\nfunc (m *Map) f(k interface{} /*K*/) bool { return m.addr(m.hash(k)) == 0 && m.eq(k, c.m.x) && m.eq != nil }\n",
+			"package p\n\nfunc (m *Map) f(k *big.Int) bool { return m.addr(hashBig(k)) == 0 && (func(a, b *big.Int) bool { return a.Cmp(b) == 0 })(k, c.m.x) && m.eq != nil }\n",
+			"hashBig", "func(a, b *big.Int) bool { return a.Cmp(b) == 0 }",
+		},
+	} {
+		fset := token.NewFileSet()
+		f, err := parser.ParseFile(fset, "x.go", v.src, parser.ParseComments)
+		if err != nil {
+			t.Fatal(i, err)
+		}
+
+		b, err := replace(fset, f, []byte(v.src), &config{key: "*big.Int", value: "string", hash: v.hash, eq: v.eq})
+		if v.out == "" {
+			if err == nil {
+				t.Fatal(i, "expected error")
+			}
+
+			continue
+		}
+
+		if err != nil {
+			t.Fatal(i, err)
+		}
+
+		if g, e := string(b), v.out; g != e {
+			t.Fatalf("%d\n%s\n%s", i, g, e)
+		}
+	}
+}
+
+// TestExample checks the generated files of the example packages are up to
+// date.
+func TestExample(t *testing.T) {
+	for _, v := range []struct {
+		dir string
+		c   *config
+	}{
+		{"example", &config{
+			key:     "*big.Int",
+			value:   "*big.Int",
+			pkg:     "hash",
+			imports: []string{"math/big"},
+			cmd:     "hashgen -key *big.Int -value *big.Int -import math/big -test -o int.go",
+		}},
+		{filepath.Join("example", "inline"), &config{
+			key:     "*big.Int",
+			value:   "*big.Int",
+			pkg:     "inline",
+			imports: []string{"math/big"},
+			hash:    "hashBigInt",
+			eq:      "eqBigInt",
+			cmd:     "hashgen -key *big.Int -value *big.Int -import math/big -hash hashBigInt -eq eqBigInt -test -o int.go",
+		}},
+	} {
+		v.c.src = filepath.Join("..", "..")
+		for name, f := range map[string]func(*config) ([]byte, error){
+			"int.go":      generate,
+			"int_test.go": generateTest,
+		} {
+			g, err := f(v.c)
+			if err != nil {
+				t.Fatal(v.dir, err)
+			}
+
+			e, err := os.ReadFile(filepath.Join("..", "..", v.dir, name))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !bytes.Equal(g, e) {
+				t.Errorf("%s/%s is out of date, run go generate in %[1]s", filepath.ToSlash(v.dir), name)
+			}
+		}
+	}
+}
@@ -0,0 +1,500 @@
+// Copyright 2017 The hash Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Command hashgen generates a type specific variant of the Map of package
+// hash.
+//
+// Usage
+//
+//	hashgen [flags]
+//
+// Flags:
+//
+//	-key type
+//		The key type, for example '*big.Int'. The zero value of the key
+//		type marks empty slots, so it must be a pointer, slice, map,
+//		channel, function or interface type.
+//	-value type
+//		The value type.
+//	-pkg name
+//		The package name of the output, $GOPACKAGE if empty.
+//	-import path[,path...]
+//		Packages imported by the output, for example the packages of
+//		the key and value types. The flag can be repeated.
+//	-o file
+//		The output file, hash.go if empty.
+//	-hash func
+//		The hash function, a func(key) int64, called directly instead
+//		of calling the hash function passed to New. Func is a function
+//		name or an expression.
+//	-eq func
+//		The eq function, a func(a, b key) bool, called directly instead
+//		of calling the eq function passed to New. Func is a function
+//		name or an expression.
+//	-test
+//		Also write a test of the output to file_test.go.
+//	-src dir
+//		The directory of package hash, located using the go command if
+//		empty.
+//
+// Hashgen replaces the key and value types, ie. the interface{} types marked
+// by /*K*/ and /*V*/ comments, in hash.go and nodebug.go of package hash and
+// writes the result to a single file. The output is type checked together
+// with the other files of its package before it is written.
+//
+// With -hash or -eq, every call of the hash or eq function of a Map is
+// replaced by a direct call of the given function, which the compiler can
+// inline, making the output free of indirect calls of these functions. The
+// hash and eq functions passed to New are then not used and may be nil.
+//
+// Hashgen can be used with go generate, for example
+//
+//	//go:generate hashgen -key *big.Int -value string -import math/big
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"go/ast"
+	"go/build"
+	"go/format"
+	"go/importer"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+const pkgPath = "github.com/cznic/hash"
+
+var (
+	oEq    = flag.String("eq", "", "eq function to call directly")
+	oHash  = flag.String("hash", "", "hash function to call directly")
+	oKey   = flag.String("key", "", "key type")
+	oO     = flag.String("o", "hash.go", "output file")
+	oPkg   = flag.String("pkg", "", "output package name, $GOPACKAGE if empty")
+	oSrc   = flag.String("src", "", "directory of package hash, located using the go command if empty")
+	oTest  = flag.Bool("test", false, "also write a test of the output")
+	oValue = flag.String("value", "", "value type")
+
+	oImports imports
+)
+
+// imports is a repeatable flag of comma separated import paths.
+type imports []string
+
+func (i *imports) String() string { return strings.Join(*i, ",") }
+
+func (i *imports) Set(s string) error {
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			*i = append(*i, v)
+		}
+	}
+	return nil
+}
+
+func init() {
+	flag.Var(&oImports, "import", "comma separated import paths, repeatable")
+}
+
+// config describes the output.
+type config struct {
+	key     string
+	value   string
+	pkg     string
+	imports []string
+	hash    string // Hash function called directly, if not empty.
+	eq      string // Eq function called directly, if not empty.
+	src     string // Directory of package hash.
+	cmd     string // Command line recorded in the output.
+}
+
+func main() {
+	flag.Parse()
+	if err := main1(); err != nil {
+		fmt.Fprintf(os.Stderr, "hashgen: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func main1() error {
+	if *oKey == "" || *oValue == "" {
+		return fmt.Errorf("both -key and -value are required")
+	}
+
+	if flag.NArg() != 0 {
+		return fmt.Errorf("unexpected arguments: %v", flag.Args())
+	}
+
+	c := &config{
+		key:     *oKey,
+		value:   *oValue,
+		pkg:     *oPkg,
+		imports: oImports,
+		hash:    *oHash,
+		eq:      *oEq,
+		src:     *oSrc,
+		cmd:     strings.Join(append([]string{"hashgen"}, os.Args[1:]...), " "),
+	}
+	if c.pkg == "" {
+		if c.pkg = os.Getenv("GOPACKAGE"); c.pkg == "" {
+			return fmt.Errorf("-pkg is required outside of go generate")
+		}
+	}
+
+	if c.src == "" {
+		p, err := build.Import(pkgPath, ".", build.FindOnly)
+		if err != nil {
+			return fmt.Errorf("locating package hash, use -src: %v", err)
+		}
+
+		c.src = p.Dir
+	}
+
+	o := filepath.Clean(*oO)
+	out := map[string][]byte{}
+	b, err := generate(c)
+	if err != nil {
+		return err
+	}
+
+	out[o] = b
+	if *oTest {
+		if out[strings.TrimSuffix(o, ".go")+"_test.go"], err = generateTest(c); err != nil {
+			return err
+		}
+	}
+
+	if err := typeCheck(filepath.Dir(o), out); err != nil {
+		return fmt.Errorf("type checking output: %v", err)
+	}
+
+	for name, b := range out {
+		if err := os.WriteFile(name, b, 0666); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// generate returns the type specific variant of hash.go and nodebug.go.
+func generate(c *config) ([]byte, error) {
+	var out bytes.Buffer
+	fmt.Fprintf(&out, "// Code generated by %s. DO NOT EDIT.\n\npackage %s\n\n", c.cmd, c.pkg)
+	var importSpecs, decls []string
+	for _, v := range c.imports {
+		importSpecs = append(importSpecs, strconv.Quote(v))
+	}
+	for _, name := range []string{"hash.go", "nodebug.go"} {
+		fset := token.NewFileSet()
+		fn := filepath.Join(c.src, name)
+		src, err := os.ReadFile(fn)
+		if err != nil {
+			return nil, err
+		}
+
+		f, err := parser.ParseFile(fset, fn, src, parser.ParseComments)
+		if err != nil {
+			return nil, err
+		}
+
+		if src, err = replace(fset, f, src, c); err != nil {
+			return nil, err
+		}
+
+		// Re-parse to locate the imports and the declarations.
+		if f, err = parser.ParseFile(fset, fn, src, parser.ParseComments); err != nil {
+			return nil, err
+		}
+
+		off := func(p token.Pos) int { return fset.Position(p).Offset }
+		start := off(f.Name.End())
+		for _, v := range f.Imports {
+			importSpecs = append(importSpecs, string(src[off(v.Pos()):off(v.End())]))
+		}
+		for _, v := range f.Decls {
+			if g, ok := v.(*ast.GenDecl); ok && g.Tok == token.IMPORT {
+				start = off(g.End())
+			}
+		}
+		decls = append(decls, strings.TrimSpace(string(src[start:])))
+	}
+
+	sort.Strings(importSpecs)
+	fmt.Fprintf(&out, "import (\n")
+	for i, v := range importSpecs {
+		if i == 0 || v != importSpecs[i-1] {
+			fmt.Fprintf(&out, "\t%s\n", v)
+		}
+	}
+	fmt.Fprintf(&out, ")\n\n%s\n", strings.Join(decls, "\n\n"))
+	b, err := format.Source(out.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("formatting output: %v", err)
+	}
+
+	return b, nil
+}
+
+// replace returns src, parsed into f, with the interface{} types marked by
+// /*K*/ and /*V*/ comments replaced by c.key and c.value and, if c.hash or
+// c.eq is not empty, with the calls of the hash or eq method values replaced
+// by calls of c.hash or c.eq.
+func replace(fset *token.FileSet, f *ast.File, src []byte, c *config) ([]byte, error) {
+	funcs := map[string]string{}
+	for name, v := range map[string]string{"hash": c.hash, "eq": c.eq} {
+		if v == "" {
+			continue
+		}
+
+		x, err := parser.ParseExpr(v)
+		if err != nil {
+			return nil, fmt.Errorf("-%s %s: %v", name, v, err)
+		}
+
+		switch x.(type) {
+		case *ast.Ident, *ast.SelectorExpr, *ast.ParenExpr:
+			funcs[name] = v
+		default:
+			funcs[name] = "(" + v + ")"
+		}
+	}
+
+	type marker struct {
+		pos, end int
+		typ      string
+		used     bool
+	}
+
+	var markers []*marker
+	for _, g := range f.Comments {
+		for _, cm := range g.List {
+			var typ string
+			switch cm.Text {
+			case "/*K*/":
+				typ = c.key
+			case "/*V*/":
+				typ = c.value
+			default:
+				continue
+			}
+
+			markers = append(markers, &marker{fset.Position(cm.Pos()).Offset, fset.Position(cm.End()).Offset, typ, false})
+		}
+	}
+
+	type edit struct {
+		pos, end int
+		text     string
+	}
+
+	var edits []edit
+	ast.Inspect(f, func(n ast.Node) bool {
+		if x, ok := n.(*ast.CallExpr); ok {
+			if sel, ok := x.Fun.(*ast.SelectorExpr); ok && funcs[sel.Sel.Name] != "" {
+				edits = append(edits, edit{fset.Position(sel.Pos()).Offset, fset.Position(sel.End()).Offset, funcs[sel.Sel.Name]})
+			}
+			return true
+		}
+
+		t, ok := n.(*ast.InterfaceType)
+		if !ok || len(t.Methods.List) != 0 {
+			return true
+		}
+
+		end := fset.Position(t.End()).Offset
+		i := sort.Search(len(markers), func(i int) bool { return markers[i].pos >= end })
+		if i == len(markers) || strings.Trim(string(src[end:markers[i].pos]), " \t") != "" {
+			return true
+		}
+
+		m := markers[i]
+		m.used = true
+		edits = append(edits, edit{fset.Position(t.Pos()).Offset, m.end, m.typ})
+		return true
+	})
+	for _, m := range markers {
+		if !m.used {
+			return nil, fmt.Errorf("%s: marker not following interface{}", fset.Position(f.FileStart+token.Pos(m.pos)))
+		}
+	}
+
+	sort.Slice(edits, func(i, j int) bool { return edits[i].pos < edits[j].pos })
+	var b []byte
+	off := 0
+	for _, e := range edits {
+		b = append(b, src[off:e.pos]...)
+		b = append(b, e.text...)
+		off = e.end
+	}
+	return append(b, src[off:]...), nil
+}
+
+var testTemplate = template.Must(template.New("test").Parse(`// Code generated by {{.Cmd}}. DO NOT EDIT.
+
+package {{.Pkg}}
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+{{range .Imports}}
+	{{printf "%q" .}}
+{{- end}}
+)
+
+// hashgenKeys returns n distinct keys, decoded from JSON encodings of
+// integers, or nil if no such encoding is decodable into distinct keys.
+func hashgenKeys(n int) []{{.Key}} {
+	var zero {{.Key}}
+outer:
+	for _, format := range []string{"%d", ` + "`" + `"%d"` + "`" + `, ` + "`" + `"%08d"` + "`" + `, "[%d]", ` + "`" + `["%d"]` + "`" + `, ` + "`" + `{"%d":0}` + "`" + `} {
+		keys := make([]{{.Key}}, n)
+		seen := map[string]bool{}
+		for i := range keys {
+			if err := json.Unmarshal([]byte(fmt.Sprintf(format, i)), &keys[i]); err != nil {
+				continue outer
+			}
+
+			s := fmt.Sprint(keys[i])
+			if seen[s] || s == fmt.Sprint(zero) {
+				continue outer
+			}
+
+			seen[s] = true
+		}
+		return keys
+	}
+	return nil
+}
+
+// hashgenHash returns the FNV-1a hash of the default format of k.
+func hashgenHash(k {{.Key}}) int64 {
+	h := uint64(14695981039346656037)
+	for _, c := range []byte(fmt.Sprint(k)) {
+		h ^= uint64(c)
+		h *= 1099511628211
+	}
+	return int64(h)
+}
+
+func hashgenEq(a, b {{.Key}}) bool { return fmt.Sprint(a) == fmt.Sprint(b) }
+
+func TestHashgenMap(t *testing.T) {
+	const n = 1000
+	keys := hashgenKeys(n)
+	if keys == nil {
+		t.Skip("cannot construct keys of type {{.Key}}")
+	}
+
+	m := New(hashgenHash, hashgenEq, 0)
+	var v {{.Value}}
+	for _, k := range keys {
+		m.Insert(k, v)
+	}
+	if g, e := m.Len(), n; g != e {
+		t.Fatal(g, e)
+	}
+
+	if err := m.Verify(); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < n; i += 2 {
+		m.Delete(keys[i])
+	}
+	for i, k := range keys {
+		if _, ok := m.Get(k); ok != (i%2 != 0) {
+			t.Fatal(i, ok)
+		}
+	}
+	cnt := 0
+	for c := m.Cursor(); c.Next(); {
+		cnt++
+	}
+	if g, e := cnt, n/2; g != e || m.Len() != e {
+		t.Fatal(g, m.Len(), e)
+	}
+}
+`))
+
+// generateTest returns a test of the output of generate.
+func generateTest(c *config) ([]byte, error) {
+	var b bytes.Buffer
+	if err := testTemplate.Execute(&b, map[string]interface{}{
+		"Cmd":     c.cmd,
+		"Imports": c.imports,
+		"Key":     c.key,
+		"Pkg":     c.pkg,
+		"Value":   c.value,
+	}); err != nil {
+		return nil, err
+	}
+
+	r, err := format.Source(b.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("formatting test: %v", err)
+	}
+
+	return r, nil
+}
+
+// typeCheck type checks the files in out together with the other files of
+// the package in dir.
+func typeCheck(dir string, out map[string][]byte) error {
+	fset := token.NewFileSet()
+	var files, tests []*ast.File
+	p, err := build.ImportDir(dir, 0)
+	if _, ok := err.(*build.NoGoError); err != nil && !ok {
+		return err
+	}
+
+	names := p.GoFiles
+	for _, name := range names {
+		fn := filepath.Join(dir, name)
+		if _, ok := out[fn]; ok {
+			continue
+		}
+
+		f, err := parser.ParseFile(fset, fn, nil, 0)
+		if err != nil {
+			return err
+		}
+
+		files = append(files, f)
+	}
+	for fn, b := range out {
+		f, err := parser.ParseFile(fset, fn, b, 0)
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case strings.HasSuffix(fn, "_test.go"):
+			tests = append(tests, f)
+		default:
+			files = append(files, f)
+		}
+	}
+
+	var errs []error
+	conf := types.Config{
+		Importer: importer.ForCompiler(fset, "source", nil),
+		Error: func(err error) {
+			if len(errs) < 10 {
+				errs = append(errs, err)
+			}
+		},
+	}
+	conf.Check(files[0].Name.Name, fset, append(files, tests...), nil)
+	return errors.Join(errs...)
+}
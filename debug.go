@@ -0,0 +1,66 @@
+// Copyright 2017 The hash Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build hashdebug
+
+package hash
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+// Every debugEqSample-th call of debugEq checks the eq function.
+const debugEqSample = 8
+
+var debugEqCalls uint64
+
+// itemDebug records the hash of a key at the time it was inserted.
+type itemDebug struct {
+	h int64
+}
+
+func newItemDebug(h int64) itemDebug { return itemDebug{h} }
+
+// debugHash panics if h is not the hash of k.
+func (m *Map) debugHash(op string, h int64, k interface{} /*K*/) {
+	if g := m.hash(k); g != h {
+		panic(fmt.Errorf("hash: %s: key %v: passed hash %#x, the hash function returns %#x", op, k, uint64(h), uint64(g)))
+	}
+}
+
+// debugTouch panics if any key in bucket b, at address a, no longer has the
+// hash it had when it was inserted.
+func (m *Map) debugTouch(op string, a uint, b []item) {
+	for i, v := range b {
+		if v.k == nil {
+			continue
+		}
+
+		if h := m.hash(v.k); h != v.d.h {
+			panic(fmt.Errorf("hash: %s: key %v in bucket %d, slot %d, was modified after insertion: its hash changed from %#x to %#x", op, v.k, a, i, uint64(v.d.h), uint64(h)))
+		}
+	}
+}
+
+// debugEq checks, for a sample of calls, that eq is reflexive and symmetric
+// for a and b and that a and b have the same hash if they are equal. It
+// panics if any of the checks fails, otherwise it returns true.
+func (m *Map) debugEq(op string, a, b interface{} /*K*/) bool {
+	if atomic.AddUint64(&debugEqCalls, 1)%debugEqSample != 0 {
+		return true
+	}
+
+	switch {
+	case !m.eq(a, a):
+		panic(fmt.Errorf("hash: %s: eq is not reflexive: eq(%v, %v) is false", op, a, a))
+	case !m.eq(b, b):
+		panic(fmt.Errorf("hash: %s: eq is not reflexive: eq(%v, %v) is false", op, b, b))
+	case m.eq(a, b) != m.eq(b, a):
+		panic(fmt.Errorf("hash: %s: eq is not symmetric: eq(%v, %v) is %v, eq(%v, %v) is %v", op, a, b, m.eq(a, b), b, a, m.eq(b, a)))
+	case m.eq(a, b) && m.hash(a) != m.hash(b):
+		panic(fmt.Errorf("hash: %s: equal keys %v and %v have different hashes %#x and %#x", op, a, b, uint64(m.hash(a)), uint64(m.hash(b))))
+	}
+	return true
+}
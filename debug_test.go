@@ -0,0 +1,73 @@
+// Copyright 2017 The hash Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build hashdebug
+
+package hash
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func mustPanic(t *testing.T, substr string, f func()) {
+	defer func() {
+		e := recover()
+		if e == nil {
+			t.Fatal("expected panic")
+		}
+
+		if !strings.Contains(fmt.Sprint(e), substr) {
+			t.Fatalf("unexpected panic: %v", e)
+		}
+
+		t.Log(e)
+	}()
+
+	f()
+}
+
+func TestDebugModifiedKey(t *testing.T) {
+	m := New(fnvBytes, cmpBytes, 0)
+	var keys [][]byte
+	for i := 0; i < 1000; i++ {
+		k := []byte(fmt.Sprintf("%04d", i))
+		keys = append(keys, k)
+		m.Insert(k, i)
+	}
+	copy(keys[42], "abcd")
+	mustPanic(t, "Get: key [97 98 99 100]", func() { m.Get([]byte("0042")) })
+}
+
+func TestDebugEq(t *testing.T) {
+	m := New(
+		func(k interface{}) int64 { return int64(k.(int) % 10) },
+		func(a, b interface{}) bool { return a.(int) <= b.(int) },
+		0,
+	)
+	mustPanic(t, "eq is not symmetric", func() {
+		for i := 0; i < 1000; i++ {
+			m.Insert(i, i)
+		}
+	})
+
+	m = New(
+		func(k interface{}) int64 { return int64(k.(int)) },
+		func(a, b interface{}) bool { return a.(int)%10 == b.(int)%10 },
+		0,
+	)
+	m.Insert(0, 0)
+	mustPanic(t, "have different hashes", func() {
+		for i := 0; i < 1000; i++ {
+			m.Get(10 * i)
+		}
+	})
+}
+
+func TestDebugHashed(t *testing.T) {
+	m := New(fnv, cmp, 0)
+	m.InsertHashed(fnv(int64(42)), int64(42), 1)
+	mustPanic(t, "GetHashed: key 42: passed hash 0x0", func() { m.GetHashed(0, int64(42)) })
+}
@@ -13,26 +13,53 @@
 // Such types are forbidden as keys of the builtin Go maps for good reasons.
 // Care must be taken to not modify keys inserted into a Map.
 //
+// Map uses linear hashing, it grows incrementally by splitting one bucket at
+// a time. FlatMap, with the same hash and eq functions, uses open addressing
+// with all items in a single slice. Its lookups are faster, see the
+// FlatGet and Get benchmarks, but it rehashes all items when it grows.
+//
 // Generic types
 //
 // Keys and their associated values are interface{} typed, similar to all of
 // the containers in the standard library.
 //
-// Semiautomatic production of a type specific variant of this package is
-// supported via
+// A type specific variant of this package is produced by the hashgen command
+//
+//	$ go install github.com/cznic/hash/cmd/hashgen
+//	$ hashgen -key '*big.Int' -value string -pkg foo -import math/big -test
+//
+// which writes hash.go, a version of the hash.go file where every key type
+// occurrence is replaced by the key type and every value type occurrence is
+// replaced by the value type, and, given the -test flag, hash_test.go, a test
+// of the generated Map. The output is type checked before it is written. The
+// key type must be nilable, the nil key marks empty slots. Hashgen works with
+// go generate, this is how, for example, 'example/int.go' is created:
+//
+//	//go:generate go run ../cmd/hashgen -key *big.Int -value *big.Int -import math/big -test -o int.go
+//
+// The -hash and -eq flags name functions, or give expressions, called
+// directly instead of the hash and eq functions of a Map, which lets the
+// compiler inline them. 'example/inline' is created this way, its benchmarks
+// compare it to 'example'.
+//
+// The same is available as
 //
-//	$ make generic
+//	$ make generic KEY='*big.Int' VALUE=string IMPORTS=math/big PKG=foo OUT=../foo/hash.go
 //
-// This command will write to stdout a version of the hash.go file where every
-// key type occurrence is replaced by the word 'KEY' and every value type
-// occurrence is replaced by the word 'VALUE'. Then you have to replace these
-// tokens with your desired type(s), using any technique you're comfortable
-// with.
+// Debugging
 //
-// This is how, for example, 'example/int.go' was created:
+// Care must be taken to not modify keys inserted into a Map and to provide
+// hash and eq functions consistent with each other. Building with the
+// hashdebug tag
 //
-//	$ mkdir example
-//	$ make generic | sed -e 's/KEY/*big.Int/g' -e 's/VALUE/*big.Int/g' > example/int.go
+//	$ go test -tags hashdebug
 //
-// After adding import "math/big", no other changes to int.go are necessary, it compiles just fine.
+// makes every Map record the hash of every key at insertion. The hashes of
+// the keys in a bucket are verified every time the bucket is accessed and the
+// eq function is checked for reflexivity, symmetry and consistency with the
+// hash function on a sample of its calls. The hashes passed to GetHashed,
+// InsertHashed and DeleteHashed are checked against the hash function. A
+// violation of any of these properties panics with a message describing the
+// offending key and operation. The Verify method can be used to check a Map
+// in non debug builds.
 package hash
@@ -0,0 +1,392 @@
+// Copyright 2017 The hash Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package hash
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+const (
+	walInsert = iota + 1
+	walDelete
+
+	walHdr = 8 // Payload length and checksum of the length and the payload.
+
+	snapshotName = "snapshot"
+	walName      = "wal"
+)
+
+// DurableOptions amend the behavior of OpenDurable.
+type DurableOptions struct {
+	// CheckpointSize is the size of the log in bytes triggering a
+	// checkpoint. Zero disables automatic checkpoints.
+	CheckpointSize int64
+
+	// SyncWrites makes every Insert and Delete commit the log to stable
+	// storage before returning.
+	SyncWrites bool
+}
+
+// DurableMap is a Map persisted in a directory. Every Insert and Delete is
+// appended to a write ahead log before it modifies the map. A checkpoint
+// writes the whole map to a snapshot, in the format of Map.WriteTo, and
+// empties the log. Opening a DurableMap loads the last snapshot and replays
+// the log.
+//
+// A DurableMap is not safe for concurrent use by multiple goroutines.
+type DurableMap struct {
+	buf  []byte
+	dir  string
+	m    *Map
+	opts DurableOptions
+	size int64 // Size of the log.
+	wal  *os.File
+}
+
+// OpenDurable opens the DurableMap stored in dir, creating it if dir holds
+// none. The items of m, which must have its codecs set, are replaced by the
+// items of the DurableMap. The hash and eq functions and the codecs of m must
+// be the same every time the DurableMap is opened. The DurableMap takes
+// ownership of m, which must not be used directly afterwards. Opts may be nil.
+//
+// A log ending with an incomplete record or a record with a checksum
+// mismatch, typically caused by a crash during a write, is truncated before
+// that record. A checksum mismatch of a record followed by other records is
+// reported as an error, truncating the log would lose them.
+func OpenDurable(dir string, m *Map, opts *DurableOptions) (*DurableMap, error) {
+	if m.codecs == nil {
+		return nil, fmt.Errorf("hash: OpenDurable: no codecs set")
+	}
+
+	d := &DurableMap{dir: dir, m: m}
+	if opts != nil {
+		d.opts = *opts
+	}
+	if err := d.load(); err != nil {
+		return nil, err
+	}
+
+	os.Remove(d.path(snapshotName + ".tmp"))
+	f, err := os.OpenFile(d.path(walName), os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return nil, err
+	}
+
+	if d.size, err = d.replay(f); err == nil {
+		if err = f.Truncate(d.size); err == nil {
+			_, err = f.Seek(d.size, io.SeekStart)
+		}
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	d.wal = f
+	return d, nil
+}
+
+func (d *DurableMap) path(name string) string { return filepath.Join(d.dir, name) }
+
+// load reads the snapshot, if any.
+func (d *DurableMap) load() error {
+	f, err := os.Open(d.path(snapshotName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			d.m.Clear()
+			return nil
+		}
+
+		return err
+	}
+
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	if _, err := d.m.ReadFrom(r); err != nil {
+		return fmt.Errorf("hash: OpenDurable: %s: %v", f.Name(), err)
+	}
+
+	if _, err := r.ReadByte(); err != io.EOF {
+		return fmt.Errorf("hash: OpenDurable: %s: trailing data", f.Name())
+	}
+
+	return nil
+}
+
+// replay applies the records of the log f to d.m and returns the size of the
+// valid part of the log.
+func (d *DurableMap) replay(f *os.File) (n int64, err error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	size := fi.Size()
+	r := bufio.NewReader(f)
+	var hdr [walHdr]byte
+	for {
+		if _, err := io.ReadFull(r, hdr[:]); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return n, nil
+			}
+
+			return 0, err
+		}
+
+		sz := binary.LittleEndian.Uint32(hdr[:])
+		end := n + walHdr + int64(sz)
+		if end > size {
+			return n, nil // An incomplete last record.
+		}
+
+		// Every record gets its own buffer, the codecs may retain it.
+		b := make([]byte, sz)
+		if _, err := io.ReadFull(r, b); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return n, nil
+			}
+
+			return 0, err
+		}
+
+		if walChecksum(hdr[:4], b) != binary.LittleEndian.Uint32(hdr[4:]) {
+			if end == size {
+				return n, nil // A torn write of the last record.
+			}
+
+			return 0, fmt.Errorf("hash: OpenDurable: %s: record at offset %d: checksum mismatch", f.Name(), n)
+		}
+
+		if err := d.apply(b); err != nil {
+			return 0, fmt.Errorf("hash: OpenDurable: %s: record at offset %d: %v", f.Name(), n, err)
+		}
+
+		n = end
+	}
+}
+
+// walChecksum returns the checksum of a log record with the encoded payload
+// length n and payload p.
+func walChecksum(n, p []byte) uint32 {
+	return crc32.Update(crc32.Checksum(n, crcTable), crcTable, p)
+}
+
+// apply applies the log record payload b to d.m.
+func (d *DurableMap) apply(b []byte) error {
+	if len(b) == 0 {
+		return fmt.Errorf("hash: empty log record")
+	}
+
+	op := b[0]
+	b = b[1:]
+	kb, b, err := walBytes(b)
+	if err != nil {
+		return err
+	}
+
+	k, err := d.m.codecs.DecodeKey(kb)
+	if err != nil {
+		return err
+	}
+
+	switch op {
+	case walInsert:
+		vb, b, err := walBytes(b)
+		if err != nil {
+			return err
+		}
+
+		if len(b) != 0 {
+			return fmt.Errorf("hash: invalid log record")
+		}
+
+		v, err := d.m.codecs.DecodeValue(vb)
+		if err != nil {
+			return err
+		}
+
+		d.m.Insert(k, v)
+	case walDelete:
+		if len(b) != 0 {
+			return fmt.Errorf("hash: invalid log record")
+		}
+
+		d.m.Delete(k)
+	default:
+		return fmt.Errorf("hash: invalid log record operation %d", op)
+	}
+	return nil
+}
+
+func walBytes(b []byte) (r, rest []byte, err error) {
+	n, i := binary.Uvarint(b)
+	if i <= 0 || n > uint64(len(b)-i) {
+		return nil, nil, fmt.Errorf("hash: invalid log record")
+	}
+
+	return b[i : i+int(n)], b[i+int(n):], nil
+}
+
+// Checkpoint writes the map to a new snapshot and empties the log.
+func (d *DurableMap) Checkpoint() error {
+	tmp := d.path(snapshotName + ".tmp")
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+
+	if _, err = d.m.WriteTo(f); err == nil {
+		err = f.Sync()
+	}
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	if err == nil {
+		err = os.Rename(tmp, d.path(snapshotName))
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	if err := syncDir(d.dir); err != nil {
+		return err
+	}
+
+	// A crash before the log is truncated is harmless, replaying the log
+	// over the new snapshot results in the same map.
+	if err := d.wal.Truncate(0); err != nil {
+		return err
+	}
+
+	if _, err := d.wal.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	d.size = 0
+	return d.wal.Sync()
+}
+
+func syncDir(dir string) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+
+	err = f.Sync()
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	return err
+}
+
+// Close closes the log of d. It does not checkpoint d.
+func (d *DurableMap) Close() error {
+	err := d.wal.Sync()
+	if err2 := d.wal.Close(); err == nil {
+		err = err2
+	}
+	return err
+}
+
+// Delete removes the item with key k, if any.
+func (d *DurableMap) Delete(k interface{} /*K*/) error {
+	if _, ok := d.m.Get(k); !ok {
+		return nil
+	}
+
+	kb, err := d.m.codecs.AppendKey(nil, k)
+	if err != nil {
+		return err
+	}
+
+	d.record(walDelete)
+	d.buf = binary.AppendUvarint(d.buf, uint64(len(kb)))
+	d.buf = append(d.buf, kb...)
+	if err := d.log(); err != nil {
+		return err
+	}
+
+	d.m.Delete(k)
+	return d.checkpoint()
+}
+
+// Get returns the value associated with k and true, or nil and false if k is
+// not in d.
+func (d *DurableMap) Get(k interface{} /*K*/) (interface{} /*V*/, bool) { return d.m.Get(k) }
+
+// Insert inserts v into d associating it with k.
+func (d *DurableMap) Insert(k interface{} /*K*/, v interface{} /*V*/) error {
+	c := d.m.codecs
+	kb, err := c.AppendKey(nil, k)
+	if err != nil {
+		return err
+	}
+
+	vb, err := c.AppendValue(nil, v)
+	if err != nil {
+		return err
+	}
+
+	d.record(walInsert)
+	d.buf = binary.AppendUvarint(d.buf, uint64(len(kb)))
+	d.buf = append(d.buf, kb...)
+	d.buf = binary.AppendUvarint(d.buf, uint64(len(vb)))
+	d.buf = append(d.buf, vb...)
+	if err := d.log(); err != nil {
+		return err
+	}
+
+	d.m.Insert(k, v)
+	return d.checkpoint()
+}
+
+// Len returns the number of items in d.
+func (d *DurableMap) Len() int { return d.m.Len() }
+
+// Sync commits the log to stable storage.
+func (d *DurableMap) Sync() error { return d.wal.Sync() }
+
+// record starts a new log record in d.buf.
+func (d *DurableMap) record(op byte) {
+	d.buf = append(d.buf[:0], make([]byte, walHdr)...)
+	d.buf = append(d.buf, op)
+}
+
+// log appends the record in d.buf to the log.
+func (d *DurableMap) log() error {
+	p := d.buf[walHdr:]
+	binary.LittleEndian.PutUint32(d.buf, uint32(len(p)))
+	binary.LittleEndian.PutUint32(d.buf[4:], walChecksum(d.buf[:4], p))
+	if _, err := d.wal.Write(d.buf); err != nil {
+		// Do not leave a partial record followed by valid ones.
+		d.wal.Truncate(d.size)
+		d.wal.Seek(d.size, io.SeekStart)
+		return err
+	}
+
+	d.size += int64(len(d.buf))
+	if d.opts.SyncWrites {
+		return d.wal.Sync()
+	}
+
+	return nil
+}
+
+// checkpoint checkpoints d if the log reached the configured size.
+func (d *DurableMap) checkpoint() error {
+	if n := d.opts.CheckpointSize; n > 0 && d.size >= n {
+		return d.Checkpoint()
+	}
+
+	return nil
+}
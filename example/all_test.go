@@ -272,6 +272,37 @@ func TestMap(t *testing.T) {
 	}
 }
 
+func TestSetTypes(t *testing.T) {
+	m := New(fnv, cmp, 0)
+	newInt := func() interface{} { return new(*big.Int) }
+	m.SetTypes(newInt, newInt)
+	data := []byte(`[{"k":1,"v":-1},{"k":2,"v":null}]`)
+	if err := m.UnmarshalJSON(data); err != nil {
+		t.Fatal(err)
+	}
+
+	if v, ok := m.Get(big.NewInt(1)); !ok || v.Int64() != -1 {
+		t.Fatal(v, ok)
+	}
+
+	if v, ok := m.Get(big.NewInt(2)); !ok || v != nil {
+		t.Fatal(v, ok)
+	}
+
+	// Functions returning pointers to other types than the key and value
+	// types are reported.
+	for _, f := range [][2]func() interface{}{
+		{func() interface{} { return new(int) }, newInt},
+		{newInt, func() interface{} { return new(int) }},
+	} {
+		m := New(fnv, cmp, 0)
+		m.SetTypes(f[0], f[1])
+		if err := m.UnmarshalJSON(data); err == nil || m.Len() != 0 {
+			t.Fatal(err, m.Len())
+		}
+	}
+}
+
 func benchmarkGet(b *testing.B, sz int) {
 	a := rnda(sz)
 	va := rnda(sz)
@@ -0,0 +1,7 @@
+// Copyright 2017 The hash Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package hash
+
+//go:generate go run ../cmd/hashgen -key *big.Int -value *big.Int -import math/big -test -o int.go
@@ -0,0 +1,88 @@
+// Copyright 2017 The hash Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package inline
+
+import (
+	"math/big"
+	"testing"
+
+	closure "github.com/cznic/hash/example"
+)
+
+const benchN = 1000
+
+func benchKeys() []*big.Int {
+	a := make([]*big.Int, benchN)
+	for i := range a {
+		a[i] = big.NewInt(int64(i) * 0x9e3779b9)
+	}
+	return a
+}
+
+func BenchmarkGet(b *testing.B) {
+	a := benchKeys()
+	b.Run("closure", func(b *testing.B) {
+		m := closure.New(hashBigInt, eqBigInt, 0)
+		for _, k := range a {
+			m.Insert(k, k)
+		}
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			for _, k := range a {
+				if _, ok := m.Get(k); !ok {
+					b.Fatal(k)
+				}
+			}
+		}
+	})
+	b.Run("inline", func(b *testing.B) {
+		m := New(nil, nil, 0)
+		for _, k := range a {
+			m.Insert(k, k)
+		}
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			for _, k := range a {
+				if _, ok := m.Get(k); !ok {
+					b.Fatal(k)
+				}
+			}
+		}
+	})
+}
+
+// BenchmarkInsertDelete deletes and reinserts the items of a filled map, which
+// does not grow. Most buckets hold a single item and are allocated again on
+// every reinsertion, that cost dominates the hash and eq calls and both
+// variants perform about the same.
+func BenchmarkInsertDelete(b *testing.B) {
+	a := benchKeys()
+	b.Run("closure", func(b *testing.B) {
+		m := closure.New(hashBigInt, eqBigInt, 0)
+		for _, k := range a {
+			m.Insert(k, k)
+		}
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			for _, k := range a {
+				m.Delete(k)
+				m.Insert(k, k)
+			}
+		}
+	})
+	b.Run("inline", func(b *testing.B) {
+		m := New(nil, nil, 0)
+		for _, k := range a {
+			m.Insert(k, k)
+		}
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			for _, k := range a {
+				m.Delete(k)
+				m.Insert(k, k)
+			}
+		}
+	})
+}
@@ -0,0 +1,25 @@
+// Copyright 2017 The hash Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package inline is a type specific variant of package hash with the hash
+// and eq functions called directly. This speeds up Get. Insert and Delete
+// gain little, their cost is dominated by allocating buckets.
+package inline
+
+import (
+	"math/big"
+)
+
+//go:generate go run ../../cmd/hashgen -key *big.Int -value *big.Int -import math/big -hash hashBigInt -eq eqBigInt -test -o int.go
+
+func hashBigInt(k *big.Int) int64 {
+	h := uint64(k.Sign())
+	for _, w := range k.Bits() {
+		h ^= uint64(w)
+		h *= 1099511628211
+	}
+	return int64(h ^ h>>32)
+}
+
+func eqBigInt(a, b *big.Int) bool { return a == b || a.Cmp(b) == 0 }
@@ -0,0 +1,181 @@
+// Copyright 2017 The hash Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package file
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func key(i int) []byte   { return []byte(fmt.Sprintf("key%d", i)) }
+func value(i int) []byte { return bytes.Repeat([]byte{byte(i)}, i%37) }
+
+func check(t *testing.T, m *Map, n int, present func(int) bool) {
+	t.Helper()
+	if g, e := m.Len(), int64(countIf(n, present)); g != e {
+		t.Fatalf("Len %d, expected %d", g, e)
+	}
+
+	for i := 0; i < n; i++ {
+		v, ok, err := m.Get(key(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if ok != present(i) || ok && !bytes.Equal(v, value(i)) {
+			t.Fatalf("%d: %v %q", i, ok, v)
+		}
+	}
+}
+
+func countIf(n int, f func(int) bool) (r int) {
+	for i := 0; i < n; i++ {
+		if f(i) {
+			r++
+		}
+	}
+	return r
+}
+
+func TestFile(t *testing.T) {
+	const n = 20000
+	name := filepath.Join(t.TempDir(), "test.db")
+	m, err := Open(name, &Options{PageSize: 256})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < n; i++ {
+		if err := m.Put(key(i), []byte("x")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < n; i++ {
+		if err := m.Put(key(i), value(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	check(t, m, n, func(int) bool { return true })
+	if len(m.dir) < n/10 {
+		t.Fatalf("%d buckets", len(m.dir))
+	}
+
+	if err := m.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if m, err = Open(name, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if g, e := m.pageSize, 256; g != e {
+		t.Fatal(g, e)
+	}
+
+	check(t, m, n, func(int) bool { return true })
+	for i := 0; i < n; i += 2 {
+		if err := m.Delete(key(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := m.Delete([]byte("foo")); err != nil {
+		t.Fatal(err)
+	}
+
+	check(t, m, n, func(i int) bool { return i%2 != 0 })
+	if err := m.Sync(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Pages released by Delete are reused.
+	pages, free := m.pages, 0
+	for p := m.free; p != 0; free++ {
+		var b [8]byte
+		if err := m.read(b[:], p); err != nil {
+			t.Fatal(err)
+		}
+
+		p = binary.LittleEndian.Uint64(b[:])
+	}
+	for i := 0; i < n; i += 2 {
+		if err := m.Put(key(i), value(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	check(t, m, n, func(int) bool { return true })
+	if free == 0 || m.pages-pages >= uint64(free) {
+		t.Fatalf("file grew from %d to %d pages, %d free pages", pages, m.pages, free)
+	}
+
+	if err := m.Put(key(0), make([]byte, 256)); err != ErrTooLarge {
+		t.Fatal(err)
+	}
+
+	if err := m.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if m, err = Open(name, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	check(t, m, n, func(int) bool { return true })
+	if err := m.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOpenErrors(t *testing.T) {
+	dir := t.TempDir()
+	if _, err := Open(filepath.Join(dir, "a"), &Options{PageSize: 1000}); err == nil {
+		t.Fatal("expected error")
+	}
+
+	name := filepath.Join(dir, "b")
+	m, err := Open(name, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.Put([]byte("foo"), []byte("bar")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// header returns b with the header field at off set to v.
+	header := func(off int, v uint64) []byte {
+		h := append([]byte(nil), b...)
+		binary.LittleEndian.PutUint64(h[off:], v)
+		binary.LittleEndian.PutUint32(h[hdrSize-4:], crc32.Checksum(h[:hdrSize-4], crcTable))
+		return h
+	}
+	for i, v := range [][]byte{
+		append([]byte("x"), b[1:]...),
+		append(append(b[:20:20], b[20]^1), b[21:]...),
+		header(8, MaxPageSize*2), // Page size.
+		header(56, 1<<40),        // Pages.
+	} {
+		if err := os.WriteFile(name, v, 0666); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := Open(name, nil); err == nil {
+			t.Fatal(i)
+		}
+	}
+}
@@ -0,0 +1,591 @@
+// Copyright 2017 The hash Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package file implements a linear hash table stored in a file.
+//
+// The buckets of the table are fixed size pages. Items not fitting into the
+// page of their bucket are stored in overflow pages chained to it. The table
+// grows one bucket at a time by splitting the bucket at the split pointer,
+// using the same level and split pointer logic as the Maps of package hash.
+// Keys are hashed using hashfn.Bytes.
+//
+// # File format
+//
+// The file is a sequence of pages. Page 0 is the header holding the
+// parameters of the table. The page numbers of the buckets are stored in a
+// chain of directory pages. Bucket and overflow pages hold the number of
+// their items and the items, every item being the uvarint encoded lengths of
+// the key and the value followed by the key and the value. The first 8 bytes
+// of every page except the header hold the number of the next page in its
+// chain, or zero. Pages no longer used are put into a free list and reused.
+//
+// The header and the directory are written only by Sync and Close. A Map not
+// closed properly is not guaranteed to be readable.
+package file
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+
+	"github.com/cznic/hash/hashfn"
+)
+
+const (
+	magic   = "lhfile"
+	version = 1
+
+	// DefaultPageSize is the page size of the files created by Open when
+	// no page size is given.
+	DefaultPageSize = 4096
+
+	// MinPageSize is the smallest supported page size.
+	MinPageSize = 128
+
+	// MaxPageSize is the largest supported page size. The number of items
+	// in a page is stored in 16 bits.
+	MaxPageSize = 1 << 16
+
+	hdrSize  = 84 // Size of the header, including the checksum.
+	pageHdr  = 10 // Next page number and the number of items.
+	nextSize = 8  // Next page number.
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// ErrTooLarge is returned by Put when the item does not fit into a page.
+var ErrTooLarge = errors.New("file: item too large")
+
+// Options amend the behavior of Open.
+type Options struct {
+	// PageSize is the page size of a newly created file, DefaultPageSize
+	// if zero. It must be a power of 2 between MinPageSize and
+	// MaxPageSize. The page size of an existing file is read from the
+	// file.
+	PageSize int
+}
+
+type item struct {
+	k, v []byte
+}
+
+// Map is a linear hash table stored in a file. Map is not safe for concurrent
+// use by multiple goroutines.
+type Map struct {
+	dir      []uint64 // Page numbers of the buckets, zero for empty buckets.
+	dirty    bool     // Header or directory not yet written.
+	f        *os.File
+	free     uint64 // Head of the free list.
+	dirPage  uint64 // First directory page.
+	l        uint
+	len      int64
+	mask     uint
+	mask2    uint
+	n        uint
+	pageSize int
+	pages    uint64 // Number of pages in the file.
+	s        uint
+}
+
+// Open opens the Map stored in the file name, creating the file if it does
+// not exist.
+func Open(name string, opts *Options) (*Map, error) {
+	f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return nil, err
+	}
+
+	m, err := open(f, opts)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return m, nil
+}
+
+func open(f *os.File, opts *Options) (*Map, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	m := &Map{f: f, n: 1}
+	if fi.Size() == 0 {
+		m.pageSize = DefaultPageSize
+		if opts != nil && opts.PageSize != 0 {
+			m.pageSize = opts.PageSize
+		}
+		if m.pageSize < MinPageSize || m.pageSize&(m.pageSize-1) != 0 || m.pageSize > MaxPageSize {
+			return nil, fmt.Errorf("file: invalid page size %d", m.pageSize)
+		}
+
+		m.pages = 1
+		m.dir = make([]uint64, m.n)
+		m.setL(0)
+		m.dirty = true
+		return m, m.Sync()
+	}
+
+	if err := m.readHeader(fi.Size()); err != nil {
+		return nil, err
+	}
+
+	if err := m.readDir(); err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+// readHeader reads the header of a file of size bytes.
+func (m *Map) readHeader(size int64) error {
+	var b [hdrSize]byte
+	if _, err := m.f.ReadAt(b[:], 0); err != nil {
+		return fmt.Errorf("file: reading header: %v", err)
+	}
+
+	if string(b[:len(magic)]) != magic {
+		return fmt.Errorf("file: invalid header: bad magic")
+	}
+
+	if b[6] != version {
+		return fmt.Errorf("file: unsupported version %d", b[6])
+	}
+
+	if g, e := binary.LittleEndian.Uint32(b[hdrSize-4:]), crc32.Checksum(b[:hdrSize-4], crcTable); g != e {
+		return fmt.Errorf("file: invalid header: checksum mismatch")
+	}
+
+	m.pageSize = int(binary.LittleEndian.Uint32(b[8:]))
+	n := binary.LittleEndian.Uint64(b[16:])
+	l := binary.LittleEndian.Uint64(b[24:])
+	s := binary.LittleEndian.Uint64(b[32:])
+	m.len = int64(binary.LittleEndian.Uint64(b[40:]))
+	buckets := binary.LittleEndian.Uint64(b[48:])
+	m.pages = binary.LittleEndian.Uint64(b[56:])
+	m.free = binary.LittleEndian.Uint64(b[64:])
+	m.dirPage = binary.LittleEndian.Uint64(b[72:])
+	if m.pageSize < MinPageSize || m.pageSize&(m.pageSize-1) != 0 || m.pageSize > MaxPageSize || n == 0 || n&(n-1) != 0 || n > 1<<32 || l > 24 || s > n<<l {
+		return fmt.Errorf("file: invalid header")
+	}
+
+	// The bucket addresses must fit in an uint.
+	if uint64(uint(n<<l)) != n<<l {
+		return fmt.Errorf("file: %d buckets at level %d not supported on this platform", n<<l, l)
+	}
+
+	m.n, m.l, m.s = uint(n), uint(l), uint(s)
+	m.setL(m.l)
+	e := uint64(m.n) << m.l
+	if m.s != 0 {
+		e = uint64(m.n)<<(m.l-1) + uint64(m.s)
+	}
+	if buckets != e || m.l == 0 && m.s != 0 || m.s > m.mask2 {
+		return fmt.Errorf("file: invalid header: %d buckets at level %d, split pointer %d", buckets, m.l, m.s)
+	}
+
+	// The pages must be in the file, bounding the size of the directory.
+	if m.pages > uint64(size)/uint64(m.pageSize) || buckets > m.pages*uint64(m.pageSize/8) {
+		return fmt.Errorf("file: invalid header: %d pages, %d buckets, file size %d", m.pages, buckets, size)
+	}
+
+	m.dir = make([]uint64, buckets)
+	return nil
+}
+
+func (m *Map) readDir() error {
+	b := make([]byte, m.pageSize)
+	per := (m.pageSize - nextSize) / 8
+	p := m.dirPage
+	for i := 0; i < len(m.dir); i += per {
+		if err := m.read(b, p); err != nil {
+			return err
+		}
+
+		for j := 0; j < per && i+j < len(m.dir); j++ {
+			e := binary.LittleEndian.Uint64(b[nextSize+8*j:])
+			if e >= m.pages {
+				return fmt.Errorf("file: invalid directory entry %d: page %d", i+j, e)
+			}
+
+			m.dir[i+j] = e
+		}
+		p = binary.LittleEndian.Uint64(b)
+	}
+	return nil
+}
+
+// read reads page p into b.
+func (m *Map) read(b []byte, p uint64) error {
+	if p == 0 || p >= m.pages {
+		return fmt.Errorf("file: invalid page number %d", p)
+	}
+
+	if _, err := m.f.ReadAt(b, int64(p)*int64(m.pageSize)); err != nil {
+		return fmt.Errorf("file: reading page %d: %v", p, err)
+	}
+
+	return nil
+}
+
+// write writes b to page p.
+func (m *Map) write(b []byte, p uint64) error {
+	if _, err := m.f.WriteAt(b, int64(p)*int64(m.pageSize)); err != nil {
+		return fmt.Errorf("file: writing page %d: %v", p, err)
+	}
+
+	return nil
+}
+
+// alloc returns the number of an unused page, taken from the free list if
+// possible.
+func (m *Map) alloc() (uint64, error) {
+	m.dirty = true
+	if p := m.free; p != 0 {
+		var b [nextSize]byte
+		if err := m.read(b[:], p); err != nil {
+			return 0, err
+		}
+
+		m.free = binary.LittleEndian.Uint64(b[:])
+		return p, nil
+	}
+
+	m.pages++
+	return m.pages - 1, nil
+}
+
+// release puts page p into the free list.
+func (m *Map) release(p uint64) error {
+	var b [nextSize]byte
+	binary.LittleEndian.PutUint64(b[:], m.free)
+	if err := m.write(b[:], p); err != nil {
+		return err
+	}
+
+	m.free = p
+	m.dirty = true
+	return nil
+}
+
+func (m *Map) addr(h int64) uint {
+	a := uint(h) & m.mask
+	if a < uint(len(m.dir)) {
+		return a
+	}
+
+	return uint(h) & m.mask2
+}
+
+func (m *Map) setL(l uint) {
+	m.mask = m.n<<l - 1
+	m.mask2 = m.mask >> 1
+	m.l = l
+}
+
+// bucket reads the chain of pages of bucket a and returns its page numbers
+// and items.
+func (m *Map) bucket(a uint) (pages []uint64, items []item, err error) {
+	for p := m.dir[a]; p != 0; {
+		if len(pages) > int(m.pages) {
+			return nil, nil, fmt.Errorf("file: bucket %d: cycle in page chain", a)
+		}
+
+		b := make([]byte, m.pageSize)
+		if err := m.read(b, p); err != nil {
+			return nil, nil, err
+		}
+
+		pages = append(pages, p)
+		n := int(binary.LittleEndian.Uint16(b[nextSize:]))
+		off := pageHdr
+		for i := 0; i < n; i++ {
+			kl, n1 := binary.Uvarint(b[off:])
+			vl, n2 := binary.Uvarint(b[off+max(n1, 0):])
+			if n1 <= 0 || n2 <= 0 || kl > uint64(len(b)) || vl > uint64(len(b)) || uint64(len(b)-off-n1-n2) < kl+vl {
+				return nil, nil, fmt.Errorf("file: bucket %d: invalid page %d", a, p)
+			}
+
+			off += n1 + n2
+			k := b[off : off+int(kl) : off+int(kl)]
+			off += int(kl)
+			v := b[off : off+int(vl) : off+int(vl)]
+			off += int(vl)
+			items = append(items, item{k, v})
+		}
+		p = binary.LittleEndian.Uint64(b)
+	}
+	return pages, items, nil
+}
+
+// setBucket writes items into the chain of pages of bucket a, reusing pages,
+// which are the pages currently used by the bucket, and returns the number
+// of pages of the new chain.
+func (m *Map) setBucket(a uint, pages []uint64, items []item) (int, error) {
+	var chain [][]byte
+	var b []byte
+	for _, v := range items {
+		sz := recSize(v.k, v.v)
+		if b == nil || len(b)+sz > m.pageSize {
+			b = make([]byte, pageHdr, m.pageSize)
+			chain = append(chain, b)
+		}
+		b = binary.AppendUvarint(b, uint64(len(v.k)))
+		b = binary.AppendUvarint(b, uint64(len(v.v)))
+		b = append(b, v.k...)
+		b = append(b, v.v...)
+		binary.LittleEndian.PutUint16(b[nextSize:], binary.LittleEndian.Uint16(b[nextSize:])+1)
+		chain[len(chain)-1] = b
+	}
+	for len(pages) < len(chain) {
+		p, err := m.alloc()
+		if err != nil {
+			return 0, err
+		}
+
+		pages = append(pages, p)
+	}
+	for _, p := range pages[len(chain):] {
+		if err := m.release(p); err != nil {
+			return 0, err
+		}
+	}
+
+	for i, b := range chain {
+		if i+1 < len(chain) {
+			binary.LittleEndian.PutUint64(b, pages[i+1])
+		}
+		if err := m.write(b[:m.pageSize], pages[i]); err != nil {
+			return 0, err
+		}
+	}
+
+	var head uint64
+	if len(chain) != 0 {
+		head = pages[0]
+	}
+	if m.dir[a] != head {
+		m.dir[a] = head
+		m.dirty = true
+	}
+	return len(chain), nil
+}
+
+func recSize(k, v []byte) int {
+	var b [2 * binary.MaxVarintLen64]byte
+	return len(binary.AppendUvarint(binary.AppendUvarint(b[:0], uint64(len(k))), uint64(len(v)))) + len(k) + len(v)
+}
+
+func find(items []item, k []byte) int {
+	for i, v := range items {
+		if string(v.k) == string(k) {
+			return i
+		}
+	}
+	return -1
+}
+
+// Delete removes the item with key k, if any.
+func (m *Map) Delete(k []byte) error {
+	a := m.addr(hashfn.Bytes(k))
+	pages, items, err := m.bucket(a)
+	if err != nil {
+		return err
+	}
+
+	i := find(items, k)
+	if i < 0 {
+		return nil
+	}
+
+	items = append(items[:i], items[i+1:]...)
+	if _, err := m.setBucket(a, pages, items); err != nil {
+		return err
+	}
+
+	m.len--
+	m.dirty = true
+	return nil
+}
+
+// Get returns the value associated with k and true, or nil and false if k is
+// not in m.
+func (m *Map) Get(k []byte) (v []byte, ok bool, err error) {
+	_, items, err := m.bucket(m.addr(hashfn.Bytes(k)))
+	if err != nil {
+		return nil, false, err
+	}
+
+	if i := find(items, k); i >= 0 {
+		return items[i].v, true, nil
+	}
+
+	return nil, false, nil
+}
+
+// Len returns the number of items in m.
+func (m *Map) Len() int64 { return m.len }
+
+// Put associates v with k. The key and the value are copied. Put returns
+// ErrTooLarge if the item does not fit into a page.
+func (m *Map) Put(k, v []byte) error {
+	if recSize(k, v) > m.pageSize-pageHdr {
+		return ErrTooLarge
+	}
+
+	a := m.addr(hashfn.Bytes(k))
+	pages, items, err := m.bucket(a)
+	if err != nil {
+		return err
+	}
+
+	switch i := find(items, k); {
+	case i >= 0:
+		items[i].v = v
+	default:
+		items = append(items, item{k, v})
+		m.len++
+		m.dirty = true
+	}
+	n, err := m.setBucket(a, pages, items)
+	if err != nil || n <= 1 || n <= len(pages) {
+		return err
+	}
+
+	return m.split()
+}
+
+// split splits the bucket at the split pointer.
+func (m *Map) split() error {
+	pages, items, err := m.bucket(m.s)
+	if err != nil {
+		return err
+	}
+
+	m.dir = append(m.dir, 0)
+	if m.s == 0 {
+		m.setL(m.l + 1)
+	}
+	var stay, move []item
+	for _, v := range items {
+		switch m.addr(hashfn.Bytes(v.k)) {
+		case m.s:
+			stay = append(stay, v)
+		default:
+			move = append(move, v)
+		}
+	}
+	if _, err := m.setBucket(m.s, pages, stay); err != nil {
+		return err
+	}
+
+	if _, err := m.setBucket(uint(len(m.dir)-1), nil, move); err != nil {
+		return err
+	}
+
+	m.s++
+	if m.s-1 == m.mask2 {
+		m.s = 0
+	}
+	m.dirty = true
+	return nil
+}
+
+// Sync writes the header and the directory of m and commits the file to
+// stable storage.
+func (m *Map) Sync() error {
+	if m.dirty {
+		if err := m.writeDir(); err != nil {
+			return err
+		}
+
+		if err := m.writeHeader(); err != nil {
+			return err
+		}
+
+		m.dirty = false
+	}
+	return m.f.Sync()
+}
+
+// Close syncs m and closes its file.
+func (m *Map) Close() error {
+	err := m.Sync()
+	if err2 := m.f.Close(); err == nil {
+		err = err2
+	}
+	return err
+}
+
+func (m *Map) writeDir() error {
+	per := (m.pageSize - nextSize) / 8
+	var pages []uint64
+	for p := m.dirPage; p != 0; {
+		var b [nextSize]byte
+		if err := m.read(b[:], p); err != nil {
+			return err
+		}
+
+		pages = append(pages, p)
+		p = binary.LittleEndian.Uint64(b[:])
+	}
+	need := (len(m.dir) + per - 1) / per
+	for len(pages) < need {
+		p, err := m.alloc()
+		if err != nil {
+			return err
+		}
+
+		pages = append(pages, p)
+	}
+	for _, p := range pages[need:] {
+		if err := m.release(p); err != nil {
+			return err
+		}
+	}
+
+	pages = pages[:need]
+	b := make([]byte, m.pageSize)
+	for i, p := range pages {
+		clear(b)
+		if i+1 < len(pages) {
+			binary.LittleEndian.PutUint64(b, pages[i+1])
+		}
+		for j, e := range m.dir[i*per : min((i+1)*per, len(m.dir))] {
+			binary.LittleEndian.PutUint64(b[nextSize+8*j:], e)
+		}
+		if err := m.write(b, p); err != nil {
+			return err
+		}
+	}
+	m.dirPage = 0
+	if len(pages) != 0 {
+		m.dirPage = pages[0]
+	}
+	return nil
+}
+
+func (m *Map) writeHeader() error {
+	b := make([]byte, m.pageSize)
+	copy(b, magic)
+	b[6] = version
+	binary.LittleEndian.PutUint32(b[8:], uint32(m.pageSize))
+	binary.LittleEndian.PutUint64(b[16:], uint64(m.n))
+	binary.LittleEndian.PutUint64(b[24:], uint64(m.l))
+	binary.LittleEndian.PutUint64(b[32:], uint64(m.s))
+	binary.LittleEndian.PutUint64(b[40:], uint64(m.len))
+	binary.LittleEndian.PutUint64(b[48:], uint64(len(m.dir)))
+	binary.LittleEndian.PutUint64(b[56:], m.pages)
+	binary.LittleEndian.PutUint64(b[64:], m.free)
+	binary.LittleEndian.PutUint64(b[72:], m.dirPage)
+	binary.LittleEndian.PutUint32(b[hdrSize-4:], crc32.Checksum(b[:hdrSize-4], crcTable))
+	if _, err := m.f.WriteAt(b, 0); err != nil {
+		return fmt.Errorf("file: writing header: %v", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,266 @@
+// Copyright 2017 The hash Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package hash
+
+import (
+	"math/bits"
+)
+
+// The control bytes of a FlatMap are processed in groups of eight, packed in
+// an uint64, using SWAR (SIMD within a register) bit manipulations.
+const (
+	flatGroup = 8
+
+	flatEmpty   = 0x80 // 1000_0000
+	flatDeleted = 0xfe // 1111_1110, full slots are 0xxx_xxxx.
+
+	flatLSB = 0x0101010101010101
+	flatMSB = 0x8080808080808080
+)
+
+type flatItem struct {
+	k interface{} /*K*/
+	v interface{} /*V*/
+}
+
+// FlatMap is a hash table using open addressing, an alternative to Map. Its
+// items are stored in a single slice, together with a slice of control bytes,
+// one per slot, holding seven bits of the hash of the key in the slot or
+// marking the slot as empty or deleted. A lookup probes groups of eight slots,
+// comparing all their control bytes at once, and compares keys only in slots
+// with matching control bytes.
+//
+// Unlike Map, which grows incrementally by splitting one bucket at a time, a
+// FlatMap rehashes all its items when it grows.
+type FlatMap struct {
+	ctrl    []uint64 // Control bytes, a group of eight per element.
+	deleted int      // Number of slots marked deleted.
+	eq      func(a, b interface{} /*K*/) bool
+	hash    func(interface{} /*K*/) int64
+	items   []flatItem
+	len     int
+	mask    uint // Number of groups - 1.
+}
+
+// NewFlat returns a newly created FlatMap able to hold initialCapacity items
+// before it grows. The hash and eq functions are the same as for New.
+func NewFlat(hash func(interface{} /*K*/) int64, eq func(a, b interface{} /*K*/) bool, initialCapacity int) *FlatMap {
+	m := &FlatMap{eq: eq, hash: hash}
+	m.init(flatGroups(initialCapacity))
+	return m
+}
+
+// flatGroups returns the number of groups holding n items within the maximum
+// load factor of 7/8.
+func flatGroups(n int) int {
+	g := (n*8/7 + flatGroup - 1) / flatGroup
+	return 1 << bits.Len(uint(max(g, 1)-1))
+}
+
+func (m *FlatMap) init(groups int) {
+	m.ctrl = make([]uint64, groups)
+	for i := range m.ctrl {
+		m.ctrl[i] = flatLSB * flatEmpty
+	}
+	m.items = make([]flatItem, groups*flatGroup)
+	m.mask = uint(groups - 1)
+	m.deleted = 0
+	m.len = 0
+}
+
+// capacity returns the number of items m holds before it grows.
+func (m *FlatMap) capacity() int { return len(m.items) * 7 / 8 }
+
+// locate returns the group index and the control byte of the hash of k. The
+// hash is mixed, the control byte uses its top seven bits.
+func (m *FlatMap) locate(k interface{} /*K*/) (g uint, c uint64) {
+	h := fmix64(uint64(m.hash(k)))
+	return uint(h) & m.mask, h >> 57
+}
+
+// flatMatch returns the bytes of group equal to c, with their high bit set.
+// Bytes above a matching one may be reported as false positives when c has
+// the value of the matching byte + 1, these are rejected by the key
+// comparison.
+func flatMatch(group, c uint64) uint64 {
+	x := group ^ flatLSB*c
+	return (x - flatLSB) &^ x & flatMSB
+}
+
+// flatMatchEmpty returns the empty bytes of group, with their high bit set.
+func flatMatchEmpty(group uint64) uint64 { return group &^ (group << 6) & flatMSB }
+
+// flatMatchFree returns the empty or deleted bytes of group, with their high
+// bit set.
+func flatMatchFree(group uint64) uint64 { return group & flatMSB }
+
+// flatFirst returns the index of the lowest byte reported by a match.
+func flatFirst(match uint64) uint { return uint(bits.TrailingZeros64(match)) / 8 }
+
+// find returns the slot holding k, or -1.
+func (m *FlatMap) find(k interface{} /*K*/) int {
+	g, c := m.locate(k)
+	for stride := uint(1); ; stride++ {
+		group := m.ctrl[g]
+		for b := flatMatch(group, c); b != 0; b &= b - 1 {
+			i := g*flatGroup + flatFirst(b)
+			if m.eq(m.items[i].k, k) {
+				return int(i)
+			}
+		}
+		if flatMatchEmpty(group) != 0 {
+			return -1
+		}
+
+		g = (g + stride) & m.mask // Triangular probing visits every group.
+	}
+}
+
+// setCtrl sets the control byte of slot i to c.
+func (m *FlatMap) setCtrl(i uint, c uint64) {
+	p := &m.ctrl[i/flatGroup]
+	s := i % flatGroup * 8
+	*p = *p&^(0xff<<s) | c<<s
+}
+
+// Clear removes all items from m. The memory allocated by m is kept for
+// reuse.
+func (m *FlatMap) Clear() {
+	for i := range m.ctrl {
+		m.ctrl[i] = flatLSB * flatEmpty
+	}
+	for i := range m.items {
+		m.items[i] = flatItem{}
+	}
+	m.deleted = 0
+	m.len = 0
+}
+
+// Delete removes the item with key k, if any.
+func (m *FlatMap) Delete(k interface{} /*K*/) {
+	i := m.find(k)
+	if i < 0 {
+		return
+	}
+
+	// A probe sequence does not continue past a group having an empty
+	// slot, so the slot can be made empty instead of deleted.
+	c := uint64(flatDeleted)
+	if flatMatchEmpty(m.ctrl[i/flatGroup]) != 0 {
+		c = flatEmpty
+	} else {
+		m.deleted++
+	}
+	m.setCtrl(uint(i), c)
+	m.items[i] = flatItem{}
+	m.len--
+}
+
+// Get returns the value associated with k and true, or nil and false if k is
+// not in m.
+func (m *FlatMap) Get(k interface{} /*K*/) (r interface{} /*V*/, ok bool) {
+	if i := m.find(k); i >= 0 {
+		return m.items[i].v, true
+	}
+
+	return r, false
+}
+
+// Grow makes room for n more items in m, after which no Insert rehashes the
+// items until m holds more than Len()+n items.
+func (m *FlatMap) Grow(n int) {
+	if n > 0 && m.len+m.deleted+n > m.capacity() {
+		m.rehash(flatGroups(m.len + n))
+	}
+}
+
+// Insert inserts v into the map associating it with k.
+func (m *FlatMap) Insert(k interface{} /*K*/, v interface{} /*V*/) {
+	g, c := m.locate(k)
+	free := -1
+	for stride := uint(1); ; stride++ {
+		group := m.ctrl[g]
+		for b := flatMatch(group, c); b != 0; b &= b - 1 {
+			i := g*flatGroup + flatFirst(b)
+			if m.eq(m.items[i].k, k) {
+				m.items[i].v = v
+				return
+			}
+		}
+		if free < 0 {
+			if b := flatMatchFree(group); b != 0 {
+				free = int(g*flatGroup + flatFirst(b))
+			}
+		}
+		if flatMatchEmpty(group) != 0 {
+			break
+		}
+
+		g = (g + stride) & m.mask
+	}
+
+	if m.ctrl[free/flatGroup]>>(free%flatGroup*8)&0xff == flatDeleted {
+		m.deleted--
+	} else if m.len+m.deleted >= m.capacity() {
+		// Reclaim the deleted slots if they make up a good part of the
+		// table, otherwise double its size.
+		n := len(m.ctrl)
+		if m.deleted < m.len/2 {
+			n *= 2
+		}
+		m.rehash(n)
+		m.Insert(k, v)
+		return
+	}
+
+	m.setCtrl(uint(free), c)
+	m.items[free] = flatItem{k, v}
+	m.len++
+}
+
+// rehash reinserts all items of m into a table of n groups.
+func (m *FlatMap) rehash(n int) {
+	ctrl, items := m.ctrl, m.items
+	m.init(n)
+	for i, group := range ctrl {
+		for b := ^group & flatMSB; b != 0; b &= b - 1 {
+			v := &items[i*flatGroup+int(flatFirst(b))]
+			m.insertNew(v.k, v.v)
+		}
+	}
+}
+
+// insertNew inserts an item with a key not in m, which has no deleted slots
+// and room for the item.
+func (m *FlatMap) insertNew(k interface{} /*K*/, v interface{} /*V*/) {
+	g, c := m.locate(k)
+	for stride := uint(1); ; stride++ {
+		if b := flatMatchEmpty(m.ctrl[g]); b != 0 {
+			i := g*flatGroup + flatFirst(b)
+			m.setCtrl(i, c)
+			m.items[i] = flatItem{k, v}
+			m.len++
+			return
+		}
+
+		g = (g + stride) & m.mask
+	}
+}
+
+// Len returns the number of items in m.
+func (m *FlatMap) Len() int { return m.len }
+
+// Range calls f for every item of m, in no particular order, until f returns
+// false. F must not modify m.
+func (m *FlatMap) Range(f func(k interface{} /*K*/, v interface{} /*V*/) bool) {
+	for i, group := range m.ctrl {
+		for b := ^group & flatMSB; b != 0; b &= b - 1 {
+			v := &m.items[i*flatGroup+int(flatFirst(b))]
+			if !f(v.k, v.v) {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,182 @@
+// Copyright 2017 The hash Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package hash
+
+import (
+	"fmt"
+	"math/bits"
+	"sort"
+)
+
+const (
+	frozenLambda = 4  // Average number of keys per CHD bucket.
+	frozenSeeds  = 16 // Number of seeds tried by Freeze.
+)
+
+// FrozenMap is an immutable map built by Map.Freeze. Its items are stored in
+// a slice, with no empty slots, at positions computed by a minimal perfect
+// hash function of the key hash. A FrozenMap is safe for concurrent use by
+// multiple goroutines.
+type FrozenMap struct {
+	disp  []uint32 // Displacements of the CHD buckets.
+	eq    func(a, b interface{} /*K*/) bool
+	hash  func(interface{} /*K*/) int64
+	items []item
+	seed  uint64
+}
+
+// Freeze returns a FrozenMap holding the items of m. Looking up a key in the
+// FrozenMap computes its hash using the hash function of m and then probes
+// exactly one slot. Freeze fails if distinct keys of m have the same hash.
+//
+// The minimal perfect hash function is constructed using the CHD algorithm:
+// the keys are distributed into buckets of about four keys and for every
+// bucket, largest first, a displacement is searched such that all its keys
+// land in free slots.
+func (m *Map) Freeze() (*FrozenMap, error) {
+	f := &FrozenMap{eq: m.eq, hash: m.hash}
+	n := m.len
+	if n == 0 {
+		return f, nil
+	}
+
+	hs := make([]uint64, 0, n)
+	items := make([]item, 0, n)
+	for _, b := range m.items {
+		for _, v := range b {
+			if v.k != nil {
+				hs = append(hs, uint64(m.hash(v.k)))
+				items = append(items, v)
+			}
+		}
+	}
+
+	s := append([]uint64(nil), hs...)
+	sort.Slice(s, func(i, j int) bool { return s[i] < s[j] })
+	for i := 1; i < len(s); i++ {
+		if s[i] == s[i-1] {
+			return nil, fmt.Errorf("hash: Freeze: distinct keys with hash %#x", s[i])
+		}
+	}
+
+	r := (n + frozenLambda - 1) / frozenLambda
+	f.disp = make([]uint32, r)
+	f.items = make([]item, n)
+	for i := 0; i < frozenSeeds; i++ {
+		f.seed = fmix64(uint64(i) + 0x9e3779b97f4a7c15)
+		if f.build(hs, items) {
+			return f, nil
+		}
+	}
+
+	return nil, fmt.Errorf("hash: Freeze: cannot construct a perfect hash function for %d keys", n)
+}
+
+// build tries to construct the displacements and place items using f.seed.
+func (f *FrozenMap) build(hs []uint64, items []item) bool {
+	n, r := uint64(len(f.items)), uint64(len(f.disp))
+
+	// Group the keys by buckets, counting sort.
+	start := make([]int, r+1)
+	for _, h := range hs {
+		start[f.bucket(h)+1]++
+	}
+	for i := 1; i < len(start); i++ {
+		start[i] += start[i-1]
+	}
+	keys := make([]int, len(hs))
+	next := append([]int(nil), start[:r]...)
+	for i, h := range hs {
+		b := f.bucket(h)
+		keys[next[b]] = i
+		next[b]++
+	}
+
+	order := make([]int, r)
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return start[order[i]+1]-start[order[i]] > start[order[j]+1]-start[order[j]]
+	})
+
+	taken := make([]uint64, (n+63)/64)
+	limit := 16*n + 1<<10
+	var slots []uint64
+	for _, b := range order {
+		bk := keys[start[b]:start[b+1]]
+		if len(bk) == 0 {
+			break
+		}
+
+	search:
+		for d := uint64(0); ; d++ {
+			if d == limit || d > 1<<32-1 {
+				return false
+			}
+
+			slots = slots[:0]
+			for _, k := range bk {
+				p := f.slot(hs[k], uint32(d))
+				if taken[p/64]&(1<<(p%64)) != 0 {
+					continue search
+				}
+
+				for _, q := range slots {
+					if q == p {
+						continue search
+					}
+				}
+
+				slots = append(slots, p)
+			}
+			for i, p := range slots {
+				taken[p/64] |= 1 << (p % 64)
+				f.items[p] = items[bk[i]]
+			}
+			f.disp[b] = uint32(d)
+			break
+		}
+	}
+	return true
+}
+
+// bucket returns the CHD bucket of hash h.
+func (f *FrozenMap) bucket(h uint64) uint64 {
+	hi, _ := bits.Mul64(fmix64(h^f.seed), uint64(len(f.disp)))
+	return hi
+}
+
+// slot returns the slot of hash h in a bucket with displacement d.
+func (f *FrozenMap) slot(h uint64, d uint32) uint64 {
+	hi, _ := bits.Mul64(fmix64(h+f.seed+(uint64(d)+1)*0xc2b2ae3d27d4eb4f), uint64(len(f.items)))
+	return hi
+}
+
+// Get returns the value associated with k and true, or nil and false if k is
+// not in f.
+func (f *FrozenMap) Get(k interface{} /*K*/) (r interface{} /*V*/, ok bool) {
+	if len(f.items) == 0 {
+		return r, false
+	}
+
+	h := uint64(f.hash(k))
+	if v := &f.items[f.slot(h, f.disp[f.bucket(h)])]; f.eq(v.k, k) {
+		return v.v, true
+	}
+
+	return r, false
+}
+
+// GetMember returns the value associated with k, which must be in f. The key
+// is not compared to the key stored in the probed slot, the result for keys
+// not in f is the value of an arbitrary item. GetMember panics if f is empty.
+func (f *FrozenMap) GetMember(k interface{} /*K*/) interface{} /*V*/ {
+	h := uint64(f.hash(k))
+	return f.items[f.slot(h, f.disp[f.bucket(h)])].v
+}
+
+// Len returns the number of items in f.
+func (f *FrozenMap) Len() int { return len(f.items) }
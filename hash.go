@@ -5,24 +5,72 @@
 package hash
 
 import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math/bits"
+	"reflect"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"unsafe"
+
 	"github.com/cznic/mathutil"
 )
 
 const threshold = 2
 
+var fns uint64 // Source of Map.fn values.
+
+// ErrModified is reported by cursors returned from CheckedCursor when their
+// Map was structurally modified during the iteration.
+var ErrModified = errors.New("hash: map structurally modified during iteration")
+
+const (
+	binaryMagic   = "lhmap"
+	binaryVersion = 1
+
+	binaryHashes = 1 // Flag: hashes and bucket layout are stored.
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
 type item struct {
+	d itemDebug
 	k interface{} /*K*/
 	v interface{} /*V*/
 }
 
+type scanItem struct {
+	item
+	r uint64 // Bit reversed hash of the key.
+}
+
 // Cursor provides enumerating of Map items.
 type Cursor struct {
 	K        interface{} /*K*/
 	V        interface{} /*V*/
+	bi       int         // Index of the next item in buf.
+	buf      []scanItem  // Buffered items of the current bucket.
+	check    bool
+	end      bool // No more buckets to scan.
+	err      error
 	hasMoved bool
 	i        int
 	j        int
+	lim      int // Bucket index limit, if not zero.
 	m        *Map
+	mod      uint64
+	panics   bool
+	pos      uint64 // Bit reversed hash where the next bucket to scan starts.
+	scan     bool
+	sorted   bool
 }
 
 // Next moves the cursor to the next item in the map and sets the K and V
@@ -42,22 +90,48 @@ type Cursor struct {
 // produced. If a map entry is created during iteration, that entry may be
 // produced during the iteration or may be skipped. The choice may vary for
 // each entry created and from one iteration to the next.
+//
+// A bucket split, caused by Insert, can move items already produced ahead of
+// the cursor and items not yet produced behind it. Such items are then
+// produced twice or skipped. Cursors returned by CheckedCursor detect this
+// situation.
 func (c *Cursor) Next() bool {
 	if c.m == nil {
 		return false
 	}
 
+	if c.check && c.mod != c.m.mod {
+		c.err = ErrModified
+		c.m = nil
+		if c.panics {
+			panic(c.err)
+		}
+
+		return false
+	}
+
+	if c.scan {
+		return c.nextScan()
+	}
+
 	if c.hasMoved {
 		c.j++
 	}
 	c.hasMoved = true
 
-	for n := len(c.m.items); c.i < n; c.i, c.j = c.i+1, 0 {
+	n := len(c.m.items)
+	if c.lim != 0 && c.lim < n {
+		n = c.lim
+	}
+	for ; c.i < n; c.i, c.j = c.i+1, 0 {
 		b := c.m.items[c.i]
 		for ; c.j < len(b); c.j++ {
 			if b[c.j].k != nil {
 				c.K = b[c.j].k
 				c.V = b[c.j].v
+				if !c.check {
+					c.mod = c.m.mod
+				}
 				return true
 			}
 		}
@@ -67,17 +141,321 @@ func (c *Cursor) Next() bool {
 	return false
 }
 
+// Err returns the error, if any, that was encountered during iteration.
+func (c *Cursor) Err() error { return c.err }
+
+// current returns the bucket and slot of the item the cursor is positioned
+// at, or panics if there's no such item.
+func (c *Cursor) current(op string) (a uint, i int) {
+	if c.m == nil || !c.hasMoved {
+		panic(fmt.Errorf("hash: Cursor.%s: cursor is not positioned at an item", op))
+	}
+
+	if c.scan {
+		a = c.m.addr(c.m.hash(c.K))
+		for i, v := range c.m.items[a] {
+			if v.k != nil && c.m.eq(v.k, c.K) {
+				return a, i
+			}
+		}
+
+		panic(fmt.Errorf("hash: Cursor.%s: item already deleted", op))
+	}
+
+	if c.mod != c.m.mod {
+		panic(ErrModified)
+	}
+
+	if c.i >= len(c.m.items) || c.j >= len(c.m.items[c.i]) || c.m.items[c.i][c.j].k == nil {
+		panic(fmt.Errorf("hash: Cursor.%s: item already deleted", op))
+	}
+
+	return uint(c.i), c.j
+}
+
+// Position is a serializable position of a Cursor returned by CursorAt. The
+// zero value of Position is the position before the first item of a Map.
+type Position struct {
+	p   uint64
+	end bool
+}
+
+// End reports whether p is the position after the last item of a Map.
+func (p Position) End() bool { return p.end }
+
+// MarshalBinary implements encoding.BinaryMarshaler.
+func (p Position) MarshalBinary() ([]byte, error) {
+	b := make([]byte, 9)
+	if p.end {
+		b[0] = 1
+	}
+	binary.LittleEndian.PutUint64(b[1:], p.p)
+	return b, nil
+}
+
+// UnmarshalBinary implements encoding.BinaryUnmarshaler.
+func (p *Position) UnmarshalBinary(b []byte) error {
+	if len(b) != 9 || b[0] > 1 {
+		return fmt.Errorf("hash: invalid Position encoding")
+	}
+
+	p.end = b[0] == 1
+	p.p = binary.LittleEndian.Uint64(b[1:])
+	return nil
+}
+
+// Position returns the position of c, ie. the position after the item c is
+// currently positioned at. Position is valid only for cursors returned by
+// CursorAt.
+func (c *Cursor) Position() Position {
+	if !c.scan || c.sorted {
+		panic(fmt.Errorf("hash: Cursor.Position: not a cursor returned by CursorAt"))
+	}
+
+	if c.bi < len(c.buf) {
+		return Position{p: c.buf[c.bi].r}
+	}
+
+	return Position{p: c.pos, end: c.end || c.m == nil}
+}
+
+func (c *Cursor) nextScan() bool {
+	for c.bi >= len(c.buf) {
+		if c.end {
+			c.m = nil
+			c.buf = nil
+			return false
+		}
+
+		c.fill()
+	}
+	v := &c.buf[c.bi]
+	c.bi++
+	c.K = v.k
+	c.V = v.v
+	c.hasMoved = true
+	return true
+}
+
+// fill buffers the items of the bucket containing the keys having bit reversed
+// hash c.pos, in the order of their bit reversed hash, and moves c.pos to the
+// end of the bucket.
+func (c *Cursor) fill() {
+	m := c.m
+	a := m.addr(int64(bits.Reverse64(c.pos)))
+	// Bucket a holds the keys having the lowest d bits of their hash equal
+	// to a, ie. the keys having their bit reversed hash in [lo, lo+2^(64-d)).
+	d := m.depth(a)
+	lo := bits.Reverse64(uint64(a))
+	c.buf = c.buf[:0]
+	c.bi = 0
+	for _, v := range m.items[a] {
+		if v.k == nil {
+			continue
+		}
+
+		if r := bits.Reverse64(uint64(m.hash(v.k))); r >= c.pos {
+			c.buf = append(c.buf, scanItem{v, r})
+		}
+	}
+	sort.SliceStable(c.buf, func(i, j int) bool { return c.buf[i].r < c.buf[j].r })
+	if d == 0 {
+		c.end = true
+		return
+	}
+
+	c.pos = lo + 1<<uint(64-d)
+	c.end = c.pos == 0
+}
+
+// Delete removes the current item, ie. the item having key c.K, from the map.
+// The item is removed directly from its slot, c.K is not rehashed, except for
+// cursors returned by CursorAt. Deleting
+// the current item does not cause the cursor to skip or produce twice any
+// other item.
+//
+// Delete panics if the cursor is not positioned at an item, if the item was
+// already deleted or if the map was structurally modified after the cursor
+// moved to the item.
+func (c *Cursor) Delete() {
+	a, i := c.current("Delete")
+	c.m.deleteAt(a, i)
+}
+
+// SetValue sets the value of the current item, ie. the item having key c.K,
+// to v. The item is updated directly in its slot, c.K is not rehashed, except
+// for cursors returned by CursorAt.
+//
+// SetValue panics in the same situations as Delete.
+func (c *Cursor) SetValue(v interface{} /*V*/) {
+	a, i := c.current("SetValue")
+	m := c.m
+	it := &m.items[a][i]
+	if m.vhash != nil {
+		h := m.hash(it.k)
+		m.digestSub(h, it.v)
+		m.digestAdd(h, v)
+	}
+	it.v = v
+	c.V = v
+}
+
+// Codecs define the binary encoding of the keys and values of a Map used by
+// its MarshalBinary, UnmarshalBinary, WriteTo and ReadFrom methods.
+type Codecs struct {
+	// AppendKey appends the encoding of k to b and returns the extended
+	// buffer.
+	AppendKey func(b []byte, k interface{} /*K*/) ([]byte, error)
+
+	// DecodeKey returns the key encoded in b by AppendKey. B is not
+	// modified afterwards, DecodeKey may retain it.
+	DecodeKey func(b []byte) (interface{} /*K*/, error)
+
+	// AppendValue appends the encoding of v to b and returns the extended
+	// buffer.
+	AppendValue func(b []byte, v interface{} /*V*/) ([]byte, error)
+
+	// DecodeValue returns the value encoded in b by AppendValue. B is not
+	// modified afterwards, DecodeValue may retain it.
+	DecodeValue func(b []byte) (interface{} /*V*/, error)
+
+	// Hashes, if true, makes the encoding include the hash of every key
+	// and the bucket layout. Such encoding is 8 bytes per item larger, but
+	// decoding it does not call the hash function of the Map and
+	// restores the bucket layout of the encoded Map. The hashes and the
+	// layout of a Map with many more buckets than items, for example after
+	// most of its items were deleted, are not included. The hashes are
+	// valid only for a Map using the same hash function, they must not be
+	// used with hash functions seeded per process, such as those of Maps
+	// returned by NewMaphash, unless encoded and decoded by the same
+	// process.
+	Hashes bool
+}
+
 // Map is a hash table.
 type Map struct {
-	eq    func(a, b interface{} /*K*/) bool
-	hash  func(interface{} /*K*/) int64
-	items [][]item
-	l     uint
-	len   int
-	mask  uint
-	mask2 uint
-	n     uint
-	s     uint
+	codecs   *Codecs
+	dsum     [2]uint64 // Digest, maintained if vhash != nil.
+	eq       func(a, b interface{} /*K*/) bool
+	fn       uint64 // Maps with equal fn have the same hash and eq functions.
+	hash     func(interface{} /*K*/) int64
+	items    [][]item
+	l        uint
+	len      int
+	mask     uint
+	mask2    uint
+	mod      uint64 // Structural modifications counter.
+	n        uint
+	newKey   func() interface{}
+	newValue func() interface{}
+	reserve  int // Insert does not split buckets while len <= reserve.
+	s        uint
+	vhash    func(interface{} /*V*/) int64
+}
+
+// Diff returns the keys of the items in b but not in a, the keys of the items
+// in a but not in b and the keys of the items in both a and b having values
+// not equal according to valueEq, which takes two values and returns whether
+// they are equal. The keys are compared using the eq function of a.
+//
+// If a and b share the hash function, ie. one was created from the other
+// using Clone or NewLike, and their buckets are laid out the same, Diff
+// compares the corresponding buckets of a and b directly, without hashing any
+// key. Otherwise every key of a and b is hashed and looked up in the other
+// map.
+func Diff(a, b *Map, valueEq func(a, b interface{} /*V*/) bool) (added, removed, changed []interface{} /*K*/) {
+	if sameLayout(a, b) {
+		for i, ba := range a.items {
+			bb := b.items[i]
+			for _, v := range ba {
+				if v.k == nil {
+					continue
+				}
+
+				switch j := a.find(bb, v.k); {
+				case j < 0:
+					removed = append(removed, v.k)
+				case !valueEq(v.v, bb[j].v):
+					changed = append(changed, v.k)
+				}
+			}
+			for _, v := range bb {
+				if v.k != nil && a.find(ba, v.k) < 0 {
+					added = append(added, v.k)
+				}
+			}
+		}
+		return added, removed, changed
+	}
+
+	for c := a.Cursor(); c.Next(); {
+		switch v, ok := b.Get(c.K); {
+		case !ok:
+			removed = append(removed, c.K)
+		case !valueEq(c.V, v):
+			changed = append(changed, c.K)
+		}
+	}
+	for c := b.Cursor(); c.Next(); {
+		if _, ok := a.Get(c.K); !ok {
+			added = append(added, c.K)
+		}
+	}
+	return added, removed, changed
+}
+
+// Equal reports whether a and b contain the same keys associated with equal
+// values according to valueEq, which takes two values and returns whether
+// they are equal. The keys are compared using the eq function of a.
+//
+// If a and b share the hash function, ie. one was created from the other
+// using Clone or NewLike, and their buckets are laid out the same, Equal
+// compares the corresponding buckets of a and b directly, without hashing any
+// key. Otherwise every key of a is hashed and looked up in b.
+func Equal(a, b *Map, valueEq func(a, b interface{} /*V*/) bool) bool {
+	if a.len != b.len {
+		return false
+	}
+
+	if sameLayout(a, b) {
+		for i, ba := range a.items {
+			bb := b.items[i]
+			for _, v := range ba {
+				if v.k == nil {
+					continue
+				}
+
+				if j := a.find(bb, v.k); j < 0 || !valueEq(v.v, bb[j].v) {
+					return false
+				}
+			}
+		}
+		return true
+	}
+
+	for c := a.Cursor(); c.Next(); {
+		if v, ok := b.Get(c.K); !ok || !valueEq(c.V, v) {
+			return false
+		}
+	}
+	return true
+}
+
+// Merge inserts all items of src into dst. If a key of src is already present
+// in dst, its value in dst is set to the result of conflict, which takes the
+// key, its value in dst and its value in src. If conflict is nil, the value
+// in src wins. Every key of src is hashed only once.
+func Merge(dst, src *Map, conflict func(k interface{} /*K*/, dv, sv interface{} /*V*/) interface{} /*V*/) {
+	for c := src.Cursor(); c.Next(); {
+		h := dst.hash(c.K)
+		v := c.V
+		if conflict != nil {
+			if dv, ok := dst.get("Merge", h, c.K); ok {
+				v = conflict(c.K, dv, v)
+			}
+		}
+		dst.insert("Merge", h, c.K, v)
+	}
 }
 
 // New returns a newly created Map. The hash function takes a key and returns
@@ -88,6 +466,7 @@ func New(hash func(interface{} /*K*/) int64, eq func(a, b interface{} /*K*/) boo
 	initialCapacity = 1 << uint(mathutil.Log2Uint64(uint64(initialCapacity)))
 	r := &Map{
 		eq:    eq,
+		fn:    atomic.AddUint64(&fns, 1),
 		hash:  hash,
 		items: make([][]item, initialCapacity),
 		n:     uint(initialCapacity),
@@ -96,14 +475,51 @@ func New(hash func(interface{} /*K*/) int64, eq func(a, b interface{} /*K*/) boo
 	return r
 }
 
-func (m *Map) addr(k interface{} /*K*/) uint {
-	h := uint(m.hash(k))
-	a := h & m.mask
+// fmix64 is the 64 bit finalizer of MurmurHash3.
+func fmix64(h uint64) uint64 {
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	h *= 0xc4ceb9fe1a85ec53
+	h ^= h >> 33
+	return h
+}
+
+// sameLayout reports whether a and b have the same hash function and bucket
+// layout, ie. whether every key is, or would be, stored in buckets at the
+// same index in both a and b.
+func sameLayout(a, b *Map) bool {
+	return a.fn == b.fn && a.n == b.n && len(a.items) == len(b.items)
+}
+
+// find returns the index of the item having key k in bucket b, or -1.
+func (m *Map) find(b []item, k interface{} /*K*/) int {
+	for i, v := range b {
+		if v.k != nil && m.eq(v.k, k) {
+			return i
+		}
+	}
+	return -1
+}
+
+func (m *Map) addr(h int64) uint {
+	a := uint(h) & m.mask
 	if a < uint(len(m.items)) {
 		return a
 	}
 
-	return h & m.mask2
+	return uint(h) & m.mask2
+}
+
+// depth returns the number of the lowest bits of a hash determining bucket a.
+func (m *Map) depth(a uint) int {
+	d := bits.Len(m.mask)
+	half := (m.mask + 1) >> 1
+	if a >= half || a+half < uint(len(m.items)) {
+		return d
+	}
+
+	return d - 1
 }
 
 func (m *Map) setL(l uint) {
@@ -112,16 +528,96 @@ func (m *Map) setL(l uint) {
 	m.l = l
 }
 
+// Clear removes all items from m. The memory allocated by m is kept for
+// reuse.
+func (m *Map) Clear() {
+	for i, b := range m.items {
+		for j := range b {
+			b[j] = item{}
+		}
+		m.items[i] = b[:0]
+	}
+	m.dsum = [2]uint64{}
+	m.len = 0
+}
+
+// Clone returns a copy of m. The buckets of m are copied without rehashing
+// the keys. The keys and values are not copied.
+func (m *Map) Clone() *Map { return m.ParallelClone(1) }
+
 // Cursor returns a new map Cursor.
 func (m *Map) Cursor() *Cursor { return &Cursor{m: m} }
 
+// CursorAt returns a new map Cursor starting at position p, as returned by the
+// Position method of a cursor previously returned by CursorAt. The zero value
+// of Position starts at the first item.
+//
+// The cursor enumerates items in the order of their bit reversed hash, an
+// order not affected by bucket splits. Enumeration can thus be interrupted and
+// later resumed from a saved position regardless of the modifications of m in
+// the meantime. Every item present in m for the whole enumeration is produced
+// at least once. It is produced exactly once unless its key has the same 64
+// bit hash as another key. Items inserted or deleted during the enumeration
+// may or may not be produced.
+//
+// The enumeration order depends only on the hashes of the keys, not on the
+// history of m. Maps with equal contents and hash functions thus enumerate
+// their items in the same order, except for the relative order of keys having
+// equal hashes. Use SortedCursor if a total order is required.
+//
+// The cursor hashes every key it enumerates and buffers the items of the
+// current bucket, its Next method is thus slower than Next of a cursor
+// returned by the Cursor method.
+func (m *Map) CursorAt(p Position) *Cursor {
+	return &Cursor{m: m, scan: true, pos: p.p, end: p.end}
+}
+
+// SortedCursor returns a new map Cursor enumerating the items of m in the
+// order of their keys as defined by less, which takes two keys and returns
+// whether a sorts before b. Maps with equal contents thus always enumerate
+// their items in the same order, regardless of their history.
+//
+// The cursor enumerates a snapshot of m made by SortedCursor. Modifications
+// of m made after SortedCursor returns do not affect the enumerated items.
+func (m *Map) SortedCursor(less func(a, b interface{} /*K*/) bool) *Cursor {
+	buf := make([]scanItem, 0, m.len)
+	for _, b := range m.items {
+		for _, v := range b {
+			if v.k != nil {
+				buf = append(buf, scanItem{item: v})
+			}
+		}
+	}
+	sort.Slice(buf, func(i, j int) bool { return less(buf[i].k, buf[j].k) })
+	return &Cursor{m: m, buf: buf, end: true, scan: true, sorted: true}
+}
+
+// CheckedCursor returns a new map Cursor which detects structural
+// modifications of m made during the iteration, ie. bucket splits caused by
+// Insert and rebuilding m by Vacuum. If such modification is detected, Next
+// panics with ErrModified if panics is true. Otherwise Next returns false and
+// the Err method of the cursor returns ErrModified.
+//
+// Updating the value of an existing key, deleting items and inserting items
+// without causing a split are not structural modifications and are allowed
+// during the iteration.
+func (m *Map) CheckedCursor(panics bool) *Cursor {
+	return &Cursor{m: m, check: true, mod: m.mod, panics: panics}
+}
+
 // Delete removes the element with key k from the map.
 func (m *Map) Delete(k interface{} /*K*/) {
-	a := m.addr(k)
+	h := m.hash(k)
+	a := m.addr(h)
 	b := m.items[a]
+	m.debugTouch("Delete", a, b)
 	for i, v := range b {
-		if v.k != nil && m.eq(v.k, k) {
+		if v.k != nil && m.debugEq("Delete", v.k, k) && m.eq(v.k, k) {
 			m.len--
+			if m.vhash != nil {
+				m.digestSub(h, v.v)
+			}
+			b[i] = item{}
 			n := len(b) - 1
 			if n == 0 {
 				m.items[a] = nil
@@ -130,39 +626,340 @@ func (m *Map) Delete(k interface{} /*K*/) {
 
 			if i == n {
 				m.items[a] = b[:n]
-				return
 			}
+			return
+		}
+	}
+}
 
-			b[i] = item{}
+// DeleteHashed is like Delete but it uses h, which must be equal to the hash
+// of k, instead of computing the hash of k.
+func (m *Map) DeleteHashed(h int64, k interface{} /*K*/) {
+	m.debugHash("DeleteHashed", h, k)
+	m.delete("DeleteHashed", h, k)
+}
+
+// delete is Delete using h. Delete repeats its code and the code of deleteAt,
+// avoiding calls on the hot path.
+func (m *Map) delete(op string, h int64, k interface{} /*K*/) {
+	a := m.addr(h)
+	b := m.items[a]
+	m.debugTouch(op, a, b)
+	for i, v := range b {
+		if v.k != nil && m.debugEq(op, v.k, k) && m.eq(v.k, k) {
+			m.deleteAt(a, i)
 			return
 		}
 	}
 }
 
+// deleteAt removes the item in slot i of bucket a.
+func (m *Map) deleteAt(a uint, i int) {
+	m.len--
+	b := m.items[a]
+	if m.vhash != nil {
+		m.digestSub(m.hash(b[i].k), b[i].v)
+	}
+	b[i] = item{}
+	n := len(b) - 1
+	if n == 0 {
+		m.items[a] = nil
+		return
+	}
+
+	if i == n {
+		m.items[a] = b[:n]
+	}
+}
+
+// DeleteFunc removes all items of m for which f returns true.
+func (m *Map) DeleteFunc(f func(k interface{} /*K*/, v interface{} /*V*/) bool) {
+	for c := m.Cursor(); c.Next(); {
+		if f(c.K, c.V) {
+			c.Delete()
+		}
+	}
+}
+
+// Digest returns an order independent 128 bit digest of the items of m. The
+// valueHash function takes a value and returns its hash. Maps with equal
+// contents, hash functions and value hash functions have equal digests
+// regardless of the order in which their items were inserted.
+//
+// The first call of Digest walks all the items of m and makes m maintain the
+// digest on every modification. Subsequent calls of Digest passing the same
+// valueHash function are O(1). Passing a different function walks the items
+// again. Functions are told apart by their code, closures differing only in
+// their captured variables must not be mixed.
+func (m *Map) Digest(valueHash func(interface{} /*V*/) int64) (r [16]byte) {
+	if m.vhash == nil || reflect.ValueOf(m.vhash).Pointer() != reflect.ValueOf(valueHash).Pointer() {
+		m.vhash = valueHash
+		m.dsum = [2]uint64{}
+		for _, b := range m.items {
+			for _, v := range b {
+				if v.k != nil {
+					m.digestAdd(m.hash(v.k), v.v)
+				}
+			}
+		}
+	}
+	binary.LittleEndian.PutUint64(r[:], m.dsum[0])
+	binary.LittleEndian.PutUint64(r[8:], m.dsum[1])
+	return r
+}
+
+// digestItem returns the 128 bit digest of an item having key hash h and
+// value v.
+func (m *Map) digestItem(h int64, v interface{} /*V*/) (lo, hi uint64) {
+	vh := uint64(m.vhash(v))
+	return fmix64(uint64(h)*0x9e3779b97f4a7c15 ^ vh), fmix64(vh*0xc2b2ae3d27d4eb4f + uint64(h) ^ 0x165667b19e3779f9)
+}
+
+func (m *Map) digestAdd(h int64, v interface{} /*V*/) {
+	lo, hi := m.digestItem(h, v)
+	var c uint64
+	m.dsum[0], c = bits.Add64(m.dsum[0], lo, 0)
+	m.dsum[1], _ = bits.Add64(m.dsum[1], hi, c)
+}
+
+func (m *Map) digestSub(h int64, v interface{} /*V*/) {
+	lo, hi := m.digestItem(h, v)
+	var b uint64
+	m.dsum[0], b = bits.Sub64(m.dsum[0], lo, 0)
+	m.dsum[1], _ = bits.Sub64(m.dsum[1], hi, b)
+}
+
 // Get returns the value associated with k and a boolean value indicating
 // whether the key is in the map.
 func (m *Map) Get(k interface{} /*K*/) (r interface{} /*V*/, ok bool) {
-	a := m.addr(k)
+	a := m.addr(m.hash(k))
+	m.debugTouch("Get", a, m.items[a])
 	for _, v := range m.items[a] {
-		if v.k != nil && m.eq(v.k, k) {
+		if v.k != nil && m.debugEq("Get", v.k, k) && m.eq(v.k, k) {
+			return v.v, true
+		}
+	}
+
+	return r, false
+}
+
+// GetHashed is like Get but it uses h, which must be equal to the hash of k,
+// instead of computing the hash of k.
+func (m *Map) GetHashed(h int64, k interface{} /*K*/) (r interface{} /*V*/, ok bool) {
+	m.debugHash("GetHashed", h, k)
+	return m.get("GetHashed", h, k)
+}
+
+// get is Get using h. Get repeats its code, avoiding a call on the hot path.
+func (m *Map) get(op string, h int64, k interface{} /*K*/) (r interface{} /*V*/, ok bool) {
+	a := m.addr(h)
+	m.debugTouch(op, a, m.items[a])
+	for _, v := range m.items[a] {
+		if v.k != nil && m.debugEq(op, v.k, k) && m.eq(v.k, k) {
 			return v.v, true
 		}
 	}
 
-	return nil, false
+	return r, false
+}
+
+// GetBatch sets values[i] to the value associated with keys[i] for every i and
+// returns the number of keys found in the map. The value of a key not found is
+// set to nil. GetBatch first hashes all the keys and then looks them up in the
+// order of their buckets. It panics if keys and values have different
+// lengths.
+func (m *Map) GetBatch(keys []interface{} /*K*/, values []interface{} /*V*/) (n int) {
+	if len(keys) != len(values) {
+		panic(fmt.Errorf("hash: GetBatch: %d keys, %d values", len(keys), len(values)))
+	}
+
+	hs, ix := m.batch(keys)
+	for _, i := range ix {
+		var ok bool
+		if values[i], ok = m.get("GetBatch", hs[i], keys[i]); ok {
+			n++
+		}
+	}
+	return n
+}
+
+// batch returns the hashes of keys and the indexes of keys ordered by the
+// addresses of their buckets. Equal addresses preserve the order of keys.
+func (m *Map) batch(keys []interface{} /*K*/) (hs []int64, ix []int) {
+	hs = make([]int64, len(keys))
+	as := make([]uint, len(keys))
+	ix = make([]int, len(keys))
+	for i, k := range keys {
+		hs[i] = m.hash(k)
+		as[i] = m.addr(hs[i])
+		ix[i] = i
+	}
+	nb := len(m.items)
+	if nb > 4*len(keys) {
+		sort.SliceStable(ix, func(i, j int) bool { return as[ix[i]] < as[ix[j]] })
+		return hs, ix
+	}
+
+	// Counting sort.
+	cnt := make([]int, nb+1)
+	for _, a := range as {
+		cnt[a+1]++
+	}
+	for i := 1; i < nb; i++ {
+		cnt[i] += cnt[i-1]
+	}
+	for i, a := range as {
+		ix[cnt[a]] = i
+		cnt[a]++
+	}
+	return hs, ix
+}
+
+// gobItem is the gob encoding of an item. A nil value is not transmitted.
+type gobItem struct {
+	K interface{} /*K*/
+	V interface{} /*V*/
+}
+
+// GobDecode implements gob.GobDecoder. The items of m are replaced by the
+// items encoded in data by GobEncode. The hash and eq functions of m must be
+// the same as those of the encoded Map.
+func (m *Map) GobDecode(data []byte) error {
+	dec := gob.NewDecoder(bytes.NewReader(data))
+	var n int
+	if err := dec.Decode(&n); err != nil {
+		return err
+	}
+
+	m2 := m.NewLike(mathutil.Min(n, len(data)))
+	m2.vhash = m.vhash
+	for i := 0; i < n; i++ {
+		var v gobItem
+		if err := dec.Decode(&v); err != nil {
+			return err
+		}
+
+		if v.K == nil {
+			return fmt.Errorf("hash: GobDecode: nil key")
+		}
+
+		m2.Insert(v.K, v.V)
+	}
+	if m2.len != n {
+		return fmt.Errorf("hash: GobDecode: %d items, %d distinct keys", n, m2.len)
+	}
+
+	m2.mod = m.mod + 1
+	*m = *m2
+	return nil
+}
+
+// GobEncode implements gob.GobEncoder. The keys and values of m must be
+// encodable by encoding/gob. Keys and values of interface types are encoded
+// with their concrete types, which must be registered using gob.Register
+// unless they are basic types like string or []byte.
+func (m *Map) GobEncode() ([]byte, error) {
+	var b bytes.Buffer
+	enc := gob.NewEncoder(&b)
+	if err := enc.Encode(m.len); err != nil {
+		return nil, err
+	}
+
+	for _, bucket := range m.items {
+		for _, v := range bucket {
+			if v.k == nil {
+				continue
+			}
+
+			if err := enc.Encode(gobItem{v.k, v.v}); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return b.Bytes(), nil
+}
+
+// Grow makes room for n more items in m. It performs up front all the bucket
+// splits needed for m to hold n more items, after which no Insert splits a
+// bucket until m holds more than Len()+n items. Grow is thus useful before a
+// bulk load of a known number of items.
+func (m *Map) Grow(n int) {
+	if n <= 0 {
+		return
+	}
+
+	m.reserve = m.len + n
+	for e := (m.reserve + threshold - 1) / threshold; len(m.items) < e; {
+		m.split("Grow")
+	}
 }
 
 // Insert inserts v into the map associating it with k.
 func (m *Map) Insert(k interface{} /*K*/, v interface{} /*V*/) {
-	a := m.addr(k)
+	h := m.hash(k)
+	a := m.addr(h)
+	b := m.items[a]
+	m.debugTouch("Insert", a, b)
+	j := -1
+	for i, bv := range b {
+		switch {
+		case bv.k == nil:
+			j = i
+		default:
+			if m.debugEq("Insert", bv.k, k) && m.eq(bv.k, k) {
+				if m.vhash != nil {
+					m.digestSub(h, b[i].v)
+					m.digestAdd(h, v)
+				}
+				b[i].v = v
+				m.items[a] = b
+				return
+			}
+		}
+	}
+
+	m.len++
+	if m.vhash != nil {
+		m.digestAdd(h, v)
+	}
+	if j >= 0 {
+		b[j] = item{newItemDebug(h), k, v}
+		return
+	}
+
+	b = append(b, item{newItemDebug(h), k, v})
+	m.items[a] = b
+	if len(b) <= threshold || m.len <= m.reserve {
+		return
+	}
+
+	m.split("Insert")
+}
+
+// InsertHashed is like Insert but it uses h, which must be equal to the hash
+// of k, instead of computing the hash of k.
+func (m *Map) InsertHashed(h int64, k interface{} /*K*/, v interface{} /*V*/) {
+	m.debugHash("InsertHashed", h, k)
+	m.insert("InsertHashed", h, k, v)
+}
+
+// insert is Insert using h. Insert repeats its code, avoiding a call on the
+// hot path.
+func (m *Map) insert(op string, h int64, k interface{} /*K*/, v interface{} /*V*/) {
+	a := m.addr(h)
 	b := m.items[a]
+	m.debugTouch(op, a, b)
 	j := -1
 	for i, bv := range b {
 		switch {
 		case bv.k == nil:
 			j = i
 		default:
-			if m.eq(bv.k, k) {
+			if m.debugEq(op, bv.k, k) && m.eq(bv.k, k) {
+				if m.vhash != nil {
+					m.digestSub(h, b[i].v)
+					m.digestAdd(h, v)
+				}
 				b[i].v = v
 				m.items[a] = b
 				return
@@ -171,19 +968,29 @@ func (m *Map) Insert(k interface{} /*K*/, v interface{} /*V*/) {
 	}
 
 	m.len++
+	if m.vhash != nil {
+		m.digestAdd(h, v)
+	}
 	if j >= 0 {
-		b[j] = item{k, v}
+		b[j] = item{newItemDebug(h), k, v}
 		return
 	}
 
-	b = append(b, item{k, v})
+	b = append(b, item{newItemDebug(h), k, v})
 	m.items[a] = b
-	if len(b) <= threshold {
+	if len(b) <= threshold || m.len <= m.reserve {
 		return
 	}
 
+	m.split(op)
+}
+
+// split splits the bucket at the split pointer.
+func (m *Map) split(op string) {
+	m.mod++
 	m.items = append(m.items, nil)
-	b = m.items[m.s]
+	b := m.items[m.s]
+	m.debugTouch(op, m.s, b)
 	m.items[m.s] = nil
 	if m.s == 0 {
 		m.setL(m.l + 1)
@@ -194,7 +1001,7 @@ outer:
 			continue
 		}
 
-		a := m.addr(v.k)
+		a := m.addr(m.hash(v.k))
 		c := m.items[a]
 		for i, w := range c {
 			if w.k == nil {
@@ -211,16 +1018,780 @@ outer:
 	}
 }
 
+// InsertBatch inserts values[i] into the map associating it with keys[i] for
+// every i. If keys contains equal keys the value associated with the last one
+// wins. InsertBatch first makes room for all the items, then hashes all the
+// keys and finally inserts the items in the order of their buckets. The room
+// made for keys already in m is not kept reserved after InsertBatch returns.
+// It panics if keys and values have different lengths.
+func (m *Map) InsertBatch(keys []interface{} /*K*/, values []interface{} /*V*/) {
+	if len(keys) != len(values) {
+		panic(fmt.Errorf("hash: InsertBatch: %d keys, %d values", len(keys), len(values)))
+	}
+
+	reserve := m.reserve
+	m.Grow(len(keys))
+	hs, ix := m.batch(keys)
+	for _, i := range ix {
+		m.insert("InsertBatch", hs[i], keys[i], values[i])
+	}
+	m.reserve = reserve
+}
+
+// Reset removes all items from m and returns it to the state it had when it
+// was created by New. The memory allocated by m is released.
+func (m *Map) Reset() {
+	m.dsum = [2]uint64{}
+	m.items = make([][]item, m.n)
+	m.len = 0
+	m.mod++
+	m.reserve = 0
+	m.s = 0
+	m.vhash = nil
+	m.setL(0)
+}
+
+// SetCodecs sets the codecs used by MarshalBinary, UnmarshalBinary, WriteTo
+// and ReadFrom.
+func (m *Map) SetCodecs(c *Codecs) { m.codecs = c }
+
+// SetTypes sets the functions used by UnmarshalJSON to create the keys and
+// values it decodes. The functions must return a new pointer to the zero
+// value of the respective type, for example
+//
+//	m.SetTypes(
+//		func() interface{} { return new([]byte) },
+//		func() interface{} { return new(*big.Int) },
+//	)
+//
+// The decoded key or value is the value the pointer points to.
+func (m *Map) SetTypes(newKey, newValue func() interface{}) {
+	m.newKey = newKey
+	m.newValue = newValue
+}
+
 // Len returns the number of items in the map.
 func (m *Map) Len() int { return m.len }
 
+// MarshalBinary implements encoding.BinaryMarshaler. The keys and values are
+// encoded using the codecs set by SetCodecs.
+//
+// The encoding is versioned and protected by a CRC-32C checksum.
+func (m *Map) MarshalBinary() ([]byte, error) {
+	var b bytes.Buffer
+	if _, err := m.WriteTo(&b); err != nil {
+		return nil, err
+	}
+
+	return b.Bytes(), nil
+}
+
+// jsonItem is the JSON encoding of a Map item.
+type jsonItem struct {
+	K json.RawMessage `json:"k"`
+	V json.RawMessage `json:"v"`
+}
+
+// MarshalJSON implements json.Marshaler. The Map is encoded as an array of
+// {"k": key, "v": value} objects.
+func (m *Map) MarshalJSON() ([]byte, error) {
+	b := []byte{'['}
+	for _, bucket := range m.items {
+		for _, v := range bucket {
+			if v.k == nil {
+				continue
+			}
+
+			k, err := json.Marshal(v.k)
+			if err != nil {
+				return nil, err
+			}
+
+			w, err := json.Marshal(v.v)
+			if err != nil {
+				return nil, err
+			}
+
+			if len(b) > 1 {
+				b = append(b, ',')
+			}
+			b = append(b, `{"k":`...)
+			b = append(b, k...)
+			b = append(b, `,"v":`...)
+			b = append(b, w...)
+			b = append(b, '}')
+		}
+	}
+	return append(b, ']'), nil
+}
+
+// NewLike returns a newly created Map using the hash and eq functions, the
+// codecs and the types of m.
+func (m *Map) NewLike(initialCapacity int) *Map {
+	r := New(m.hash, m.eq, initialCapacity)
+	r.codecs = m.codecs
+	r.fn = m.fn
+	r.newKey = m.newKey
+	r.newValue = m.newValue
+	return r
+}
+
+// Stats describes the internal state of a Map.
+type Stats struct {
+	Buckets        int     // Number of buckets.
+	Level          uint    // Current level.
+	Split          uint    // Index of the next bucket to split.
+	EmptyBuckets   int     // Number of buckets without any item.
+	Tombstones     int     // Number of vacant slots left by deleted items.
+	Histogram      []int   // Histogram[n] is the number of buckets having n items.
+	MaxChain       int     // Maximum number of items in a bucket.
+	ProbesHit      float64 // Average number of slots examined by a successful lookup.
+	ProbesMiss     float64 // Average number of slots examined by an unsuccessful lookup.
+	Bytes          int64   // Memory used by the Map, excluding the memory referred to by keys and values.
+	Len            int     // Number of items.
+	InitialBuckets int     // Number of buckets at level zero.
+}
+
+// Stats returns statistics of m. The bucket distribution reported can be used
+// to assess the quality of the hash function used by m.
+//
+// Stats walks all the buckets of m, it is an O(n) operation.
+func (m *Map) Stats() *Stats {
+	r := &Stats{
+		Buckets:        len(m.items),
+		Level:          m.l,
+		Split:          m.s,
+		Len:            m.len,
+		InitialBuckets: int(m.n),
+		Bytes:          int64(unsafe.Sizeof(*m)) + int64(cap(m.items))*int64(unsafe.Sizeof([]item(nil))),
+	}
+	var hits, slots int
+	for _, b := range m.items {
+		r.Bytes += int64(cap(b)) * int64(unsafe.Sizeof(item{}))
+		slots += len(b)
+		n := 0
+		for j, v := range b {
+			if v.k == nil {
+				r.Tombstones++
+				continue
+			}
+
+			n++
+			hits += j + 1
+		}
+		if n == 0 {
+			r.EmptyBuckets++
+		}
+		for len(r.Histogram) <= n {
+			r.Histogram = append(r.Histogram, 0)
+		}
+		r.Histogram[n]++
+		if n > r.MaxChain {
+			r.MaxChain = n
+		}
+	}
+	if m.len != 0 {
+		r.ProbesHit = float64(hits) / float64(m.len)
+	}
+	if len(m.items) != 0 {
+		r.ProbesMiss = float64(slots) / float64(len(m.items))
+	}
+	return r
+}
+
+// UnmarshalBinary implements encoding.BinaryUnmarshaler. The items of m are
+// replaced by the items encoded in data by MarshalBinary or WriteTo. The keys
+// and values are decoded using the codecs set by SetCodecs. The hash and eq
+// functions of m must be the same as those of the encoded Map.
+func (m *Map) UnmarshalBinary(data []byte) error {
+	r := bytes.NewReader(data)
+	m2, _, err := m.readFrom(r)
+	if err != nil {
+		return err
+	}
+
+	if r.Len() != 0 {
+		return fmt.Errorf("hash: UnmarshalBinary: %d bytes of trailing data", r.Len())
+	}
+
+	*m = *m2
+	return nil
+}
+
+// UnmarshalJSON implements json.Unmarshaler. The items of m are replaced by
+// the items encoded in data by MarshalJSON. The keys and values are decoded
+// into the pointers returned by the functions set by SetTypes or, where such
+// function is nil, directly into a key or value. The hash and eq functions of m
+// must be the same as those of the encoded Map.
+func (m *Map) UnmarshalJSON(data []byte) error {
+	var a []jsonItem
+	if err := json.Unmarshal(data, &a); err != nil {
+		return err
+	}
+
+	m2 := m.NewLike(len(a))
+	m2.vhash = m.vhash
+	for _, v := range a {
+		k, err := m.decodeKey(v.K)
+		if err != nil {
+			return err
+		}
+
+		if k == nil {
+			return fmt.Errorf("hash: UnmarshalJSON: nil key")
+		}
+
+		w, err := m.decodeValue(v.V)
+		if err != nil {
+			return err
+		}
+
+		m2.Insert(k, w)
+	}
+	if m2.len != len(a) {
+		return fmt.Errorf("hash: UnmarshalJSON: %d items, %d distinct keys", len(a), m2.len)
+	}
+
+	m2.mod = m.mod + 1
+	*m = *m2
+	return nil
+}
+
+// decodeKey returns the key encoded in b, decoded into the pointer returned
+// by m.newKey or, if m.newKey is nil, directly into a key.
+func (m *Map) decodeKey(b []byte) (k interface{} /*K*/, err error) {
+	if m.newKey == nil {
+		err = json.Unmarshal(b, &k)
+		return k, err
+	}
+
+	p := m.newKey()
+	if err := json.Unmarshal(b, p); err != nil {
+		return k, err
+	}
+
+	x := reflect.ValueOf(p).Elem().Interface()
+	if k, ok := x.(interface{} /*K*/); ok || x == nil {
+		return k, nil
+	}
+
+	return k, fmt.Errorf("hash: decoded key of type %T", x)
+}
+
+// decodeValue returns the value encoded in b, decoded into the pointer
+// returned by m.newValue or, if m.newValue is nil, directly into a value.
+func (m *Map) decodeValue(b []byte) (v interface{} /*V*/, err error) {
+	if m.newValue == nil {
+		err = json.Unmarshal(b, &v)
+		return v, err
+	}
+
+	p := m.newValue()
+	if err := json.Unmarshal(b, p); err != nil {
+		return v, err
+	}
+
+	x := reflect.ValueOf(p).Elem().Interface()
+	if v, ok := x.(interface{} /*V*/); ok || x == nil {
+		return v, nil
+	}
+
+	return v, fmt.Errorf("hash: decoded value of type %T", x)
+}
+
+// Verify checks the consistency of m and returns an error describing the
+// first violation found, if any. Verify detects, among others, keys modified
+// after being inserted into m and keys considered equal by the eq function
+// while having different hashes. The latter are detected only when they are
+// in the same bucket, Verify compares only the keys within each bucket.
+//
+// Verify walks all the buckets of m, its cost is O(n*b) where b is the
+// maximum number of items in a bucket.
+func (m *Map) Verify() error {
+	if err := m.checkLayout(); err != nil {
+		return err
+	}
+
+	n := 0
+	for a, b := range m.items {
+		for i, v := range b {
+			if v.k == nil {
+				continue
+			}
+
+			n++
+			if g := m.addr(m.hash(v.k)); g != uint(a) {
+				return fmt.Errorf("hash: key %v in bucket %d, slot %d, hashes to bucket %d", v.k, a, i, g)
+			}
+
+			for j, w := range b[:i] {
+				if w.k != nil && m.eq(w.k, v.k) {
+					return fmt.Errorf("hash: duplicate keys %v and %v in bucket %d, slots %d and %d", w.k, v.k, a, j, i)
+				}
+			}
+		}
+	}
+	if n != m.len {
+		return fmt.Errorf("hash: found %d items, Len is %d", n, m.len)
+	}
+
+	return nil
+}
+
+// checkLayout checks the consistency of the bucket layout of m.
+func (m *Map) checkLayout() error {
+	if m.n == 0 || m.n&(m.n-1) != 0 {
+		return fmt.Errorf("hash: invalid initial number of buckets %d", m.n)
+	}
+
+	if g, e := m.mask, m.n<<m.l-1; g != e {
+		return fmt.Errorf("hash: mask is %#x, expected %#x at level %d", g, e, m.l)
+	}
+
+	if g, e := m.mask2, m.mask>>1; g != e {
+		return fmt.Errorf("hash: mask2 is %#x, expected %#x at level %d", g, e, m.l)
+	}
+
+	if m.l == 0 && m.s != 0 || m.s > m.mask2 {
+		return fmt.Errorf("hash: split pointer %d out of range at level %d", m.s, m.l)
+	}
+
+	if g, e := uint(len(m.items)), m.buckets(); g != e {
+		return fmt.Errorf("hash: number of buckets is %d, expected %d at level %d, split pointer %d", g, e, m.l, m.s)
+	}
+
+	return nil
+}
+
+// maxBuckets returns the maximum number of buckets of an encoded bucket layout
+// of n items. Decoding a layout allocates its buckets, the limit makes the
+// allocation proportional to the size of the encoding.
+func maxBuckets(n int) uint64 { return 2*uint64(n) + 1024 }
+
+// buckets returns the number of buckets implied by m.n, m.l and m.s.
+func (m *Map) buckets() uint {
+	if m.s != 0 {
+		return m.n<<(m.l-1) + m.s
+	}
+
+	return m.n << m.l
+}
+
+// WriteTo implements io.WriterTo. It writes the encoding of m, as produced by
+// MarshalBinary, to w.
+func (m *Map) WriteTo(w io.Writer) (n int64, err error) {
+	c := m.codecs
+	if c == nil {
+		return 0, fmt.Errorf("hash: no codecs set")
+	}
+
+	bw := bufio.NewWriter(w)
+	crc := uint32(0)
+	var b []byte
+	flush := func() error {
+		crc = crc32.Update(crc, crcTable, b)
+		nw, err := bw.Write(b)
+		n += int64(nw)
+		b = b[:0]
+		return err
+	}
+
+	var flags byte
+	hashes := c.Hashes && uint64(m.buckets()) <= maxBuckets(m.len)
+	if hashes {
+		flags |= binaryHashes
+	}
+	b = append(b, binaryMagic...)
+	b = append(b, binaryVersion, flags)
+	b = binary.AppendUvarint(b, uint64(m.len))
+	if hashes {
+		b = binary.AppendUvarint(b, uint64(m.n))
+		b = binary.AppendUvarint(b, uint64(m.l))
+		b = binary.AppendUvarint(b, uint64(m.s))
+	}
+	var kb, vb []byte
+	for _, bucket := range m.items {
+		for _, v := range bucket {
+			if v.k == nil {
+				continue
+			}
+
+			if hashes {
+				b = binary.LittleEndian.AppendUint64(b, uint64(m.hash(v.k)))
+			}
+			if kb, err = c.AppendKey(kb[:0], v.k); err != nil {
+				return n, err
+			}
+
+			if vb, err = c.AppendValue(vb[:0], v.v); err != nil {
+				return n, err
+			}
+
+			b = binary.AppendUvarint(b, uint64(len(kb)))
+			b = append(b, kb...)
+			b = binary.AppendUvarint(b, uint64(len(vb)))
+			b = append(b, vb...)
+			if len(b) >= 4096 {
+				if err = flush(); err != nil {
+					return n, err
+				}
+			}
+		}
+	}
+	if err = flush(); err != nil {
+		return n, err
+	}
+
+	b = binary.LittleEndian.AppendUint32(b, crc)
+	if err = flush(); err != nil {
+		return n, err
+	}
+
+	return n, bw.Flush()
+}
+
+// ReadFrom implements io.ReaderFrom. The items of m are replaced by the items
+// encoded in the data read from r, as written by WriteTo or returned by
+// MarshalBinary. The keys and values are decoded using the codecs set by
+// SetCodecs. The hash and eq functions of m must be the same as those of the
+// encoded Map.
+//
+// If r does not implement io.ByteReader, ReadFrom may read past the end of the
+// encoded data. If ReadFrom fails, m is not modified.
+func (m *Map) ReadFrom(r io.Reader) (n int64, err error) {
+	m2, n, err := m.readFrom(r)
+	if err == nil {
+		*m = *m2
+	}
+	return n, err
+}
+
+func (m *Map) readFrom(r io.Reader) (m2 *Map, n int64, err error) {
+	c := m.codecs
+	if c == nil {
+		return nil, 0, fmt.Errorf("hash: no codecs set")
+	}
+
+	br, ok := r.(byteReader)
+	if !ok {
+		br = bufio.NewReader(r)
+	}
+	cr := &crcReader{r: br}
+	defer func() {
+		n = cr.n
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+	}()
+
+	var hdr [len(binaryMagic) + 2]byte
+	if _, err := io.ReadFull(cr, hdr[:]); err != nil {
+		return nil, 0, err
+	}
+
+	if string(hdr[:len(binaryMagic)]) != binaryMagic {
+		return nil, 0, fmt.Errorf("hash: invalid encoding: bad magic")
+	}
+
+	if v := hdr[len(binaryMagic)]; v != binaryVersion {
+		return nil, 0, fmt.Errorf("hash: unsupported encoding version %d", v)
+	}
+
+	flags := hdr[len(binaryMagic)+1]
+	if flags&^binaryHashes != 0 {
+		return nil, 0, fmt.Errorf("hash: invalid encoding: unknown flags %#x", flags)
+	}
+
+	cnt, err := cr.uvarint()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	hashes := flags&binaryHashes != 0
+	var geom [3]int // n, l, s
+	if hashes {
+		for i := range geom {
+			if geom[i], err = cr.uvarint(); err != nil {
+				return nil, 0, err
+			}
+		}
+	}
+
+	// The items are collected first, so no memory is allocated for the
+	// layout before the checksum is verified.
+	var a []scanItem
+	for i := 0; i < cnt; i++ {
+		var h uint64
+		if hashes {
+			var b [8]byte
+			if _, err := io.ReadFull(cr, b[:]); err != nil {
+				return nil, 0, err
+			}
+
+			h = binary.LittleEndian.Uint64(b[:])
+		}
+		kb, err := cr.bytes()
+		if err != nil {
+			return nil, 0, err
+		}
+
+		vb, err := cr.bytes()
+		if err != nil {
+			return nil, 0, err
+		}
+
+		k, err := c.DecodeKey(kb)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		v, err := c.DecodeValue(vb)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		a = append(a, scanItem{item{newItemDebug(int64(h)), k, v}, h})
+	}
+
+	crc := cr.crc
+	var b [4]byte
+	if _, err := io.ReadFull(cr, b[:]); err != nil {
+		return nil, 0, err
+	}
+
+	if binary.LittleEndian.Uint32(b[:]) != crc {
+		return nil, 0, fmt.Errorf("hash: invalid encoding: checksum mismatch")
+	}
+
+	switch {
+	case hashes:
+		bn, l, s := uint64(geom[0]), geom[1], uint64(geom[2])
+		if bn == 0 || bn&(bn-1) != 0 || l > 40 || bits.Len64(bn)+l > 40 || s != 0 && (l == 0 || s >= bn<<(l-1)) {
+			return nil, 0, fmt.Errorf("hash: invalid encoding: bucket layout out of range")
+		}
+
+		nb := bn << l
+		if s != 0 {
+			nb = bn<<(l-1) + s
+		}
+		if nb > maxBuckets(cnt) || uint64(uint(nb)) != nb {
+			return nil, 0, fmt.Errorf("hash: invalid encoding: %d buckets for %d items", nb, cnt)
+		}
+
+		m2 = m.NewLike(1)
+		m2.n = uint(bn)
+		m2.s = uint(s)
+		m2.setL(uint(l))
+		m2.items = make([][]item, m2.buckets())
+		if err := m2.checkLayout(); err != nil {
+			return nil, 0, fmt.Errorf("hash: invalid encoding: %v", err)
+		}
+
+		m2.vhash = m.vhash
+		for _, v := range a {
+			i := m2.addr(int64(v.r))
+			m2.items[i] = append(m2.items[i], v.item)
+			if m2.vhash != nil {
+				m2.digestAdd(int64(v.r), v.v)
+			}
+		}
+		m2.len = len(a)
+	default:
+		m2 = m.NewLike(cnt)
+		m2.vhash = m.vhash
+		for _, v := range a {
+			m2.Insert(v.k, v.v)
+		}
+		if m2.len != cnt {
+			return nil, 0, fmt.Errorf("hash: invalid encoding: %d items, %d distinct keys", cnt, m2.len)
+		}
+	}
+
+	m2.mod = m.mod + 1
+	return m2, cr.n, nil
+}
+
+type byteReader interface {
+	io.ByteReader
+	io.Reader
+}
+
+// crcReader computes the CRC-32C checksum of the data read through it.
+type crcReader struct {
+	b   [1]byte
+	buf []byte // Unused part of the memory handed out by bytes.
+	crc uint32
+	n   int64
+	r   byteReader
+}
+
+// ReadByte is used only for uvarints, other data are read by Read.
+func (r *crcReader) ReadByte() (byte, error) {
+	c, err := r.r.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+
+	r.b[0] = c
+	r.crc = crc32.Update(r.crc, crcTable, r.b[:])
+	r.n++
+	return c, nil
+}
+
+func (r *crcReader) Read(b []byte) (n int, err error) {
+	n, err = r.r.Read(b)
+	r.crc = crc32.Update(r.crc, crcTable, b[:n])
+	r.n += int64(n)
+	return n, err
+}
+
+func (r *crcReader) uvarint() (int, error) {
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return 0, err
+	}
+
+	if n > 1<<40 || uint64(int(n)) != n {
+		return 0, fmt.Errorf("hash: invalid encoding: value %d out of range", n)
+	}
+
+	return int(n), nil
+}
+
+// bytes reads a length prefixed byte slice. The slices it returns do not share
+// memory and are not reused, the codecs may retain them.
+func (r *crcReader) bytes() ([]byte, error) {
+	n, err := r.uvarint()
+	if err != nil {
+		return nil, err
+	}
+
+	if n > len(r.buf) {
+		if n > 1<<10 {
+			// Not preallocated, a malformed length does not allocate
+			// more than the input holds.
+			b, err := io.ReadAll(io.LimitReader(r, int64(n)))
+			if err == nil && len(b) < n {
+				err = io.ErrUnexpectedEOF
+			}
+			return b, err
+		}
+
+		r.buf = make([]byte, 1<<12)
+	}
+	b := r.buf[:n:n]
+	r.buf = r.buf[n:]
+	_, err = io.ReadFull(r, b)
+	return b, err
+}
+
 // Vacuum rebuilds m, repacking it into a possibly smaller amount of memory.
 func (m *Map) Vacuum() {
-	m2 := New(m.hash, m.eq, m.Len())
+	m2 := m.NewLike(m.Len())
+	vhash := m.vhash
+	m.vhash = nil // The digest does not change, no need to maintain it below.
 	c := m.Cursor()
 	for c.Next() {
-		m.Delete(c.K)
+		c.Delete()
 		m2.Insert(c.K, c.V)
 	}
+	m2.dsum = m.dsum
+	m2.mod = m.mod + 1
+	m2.vhash = vhash
+	*m = *m2
+}
+
+// Partitions returns at most n cursors enumerating disjoint ranges of the
+// buckets of m. Together the cursors enumerate all items of m. The cursors
+// can be used concurrently, for example by n goroutines, provided m is not
+// modified until all of them are done.
+func (m *Map) Partitions(n int) []*Cursor {
+	nb := len(m.items)
+	n = mathutil.Max(1, mathutil.Min(n, nb))
+	r := make([]*Cursor, n)
+	for i := range r {
+		r[i] = &Cursor{m: m, i: i * nb / n, lim: (i + 1) * nb / n}
+	}
+	return r
+}
+
+// parallel calls f concurrently for a copy of every cursor in cs, returned by
+// Partitions, and its index and waits for all of the calls to return. The
+// cursors in cs are not advanced and can be passed to parallel again. A
+// single partition is processed by the calling goroutine.
+func parallel(cs []*Cursor, f func(i int, c *Cursor)) {
+	if len(cs) == 1 {
+		c := *cs[0]
+		f(0, &c)
+		return
+	}
+
+	var wg sync.WaitGroup
+	for i, c := range cs {
+		wg.Add(1)
+		go func(i int, c Cursor) {
+			defer wg.Done()
+
+			f(i, &c)
+		}(i, *c)
+	}
+	wg.Wait()
+}
+
+// ParallelClone returns a copy of m. The buckets of m are copied, without
+// rehashing the keys, by n goroutines. The keys and values are not copied.
+func (m *Map) ParallelClone(n int) *Map {
+	r := *m
+	r.items = make([][]item, len(m.items), cap(m.items))
+	parallel(m.Partitions(n), func(_ int, c *Cursor) {
+		for i := c.i; i < c.lim; i++ {
+			if b := m.items[i]; b != nil {
+				r.items[i] = append([]item(nil), b...)
+			}
+		}
+	})
+	return &r
+}
+
+// ParallelVacuum is like Vacuum but it rebuilds m using n goroutines. The
+// items of the rebuilt map are stored in a single memory block. The hash
+// function of m is called concurrently by the goroutines, it must be safe for
+// concurrent use.
+func (m *Map) ParallelVacuum(n int) {
+	m2 := m.NewLike(m.Len())
+	// Hashes of the keys of every partition in the enumeration order.
+	cs := m.Partitions(n)
+	hs := make([][]int64, len(cs))
+	cnt := make([]int32, len(m2.items))
+	parallel(cs, func(p int, c *Cursor) {
+		var h []int64
+		for c.Next() {
+			x := m.hash(c.K)
+			h = append(h, x)
+			atomic.AddInt32(&cnt[m2.addr(x)], 1)
+		}
+		hs[p] = h
+	})
+
+	all := make([]item, m.len)
+	off := 0
+	for a, v := range cnt {
+		if v != 0 {
+			m2.items[a] = all[off : off+int(v) : off+int(v)]
+			off += int(v)
+		}
+		cnt[a] = 0
+	}
+	parallel(cs, func(p int, c *Cursor) {
+		h := hs[p]
+		for i := 0; c.Next(); i++ {
+			a := m2.addr(h[i])
+			m2.items[a][atomic.AddInt32(&cnt[a], 1)-1] = item{newItemDebug(h[i]), c.K, c.V}
+		}
+	})
+	m2.len = m.len
+	m2.dsum = m.dsum
+	m2.mod = m.mod + 1
+	m2.vhash = m.vhash
 	*m = *m2
 }
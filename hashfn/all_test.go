@@ -0,0 +1,90 @@
+// Copyright 2017 The hash Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package hashfn
+
+import (
+	"fmt"
+	"math/big"
+	"testing"
+
+	"github.com/cznic/hash"
+)
+
+func TestTuple(t *testing.T) {
+	h, eq := Tuple3(Bytes, EqBytes, Int, Equal, BigInt, EqBigInt)
+	m := hash.New(h, eq, 0)
+	const n = 100000
+	for i := 0; i < n; i++ {
+		m.Insert(Tuple{[]byte(fmt.Sprint(i)), i, big.NewInt(int64(-i))}, i)
+	}
+	if g, e := m.Len(), n; g != e {
+		t.Fatal(g, e)
+	}
+
+	for i := 0; i < n; i++ {
+		v, ok := m.Get(Tuple{[]byte(fmt.Sprint(i)), i, big.NewInt(int64(-i))})
+		if !ok || v != i {
+			t.Fatal(i, ok, v)
+		}
+
+		if _, ok := m.Get(Tuple{[]byte(fmt.Sprint(i)), i + 1, big.NewInt(int64(-i))}); ok {
+			t.Fatal(i)
+		}
+	}
+
+	h, _ = Tuple2(Int, Equal, Int, Equal)
+	if h(Tuple{1, 2}) == h(Tuple{2, 1}) {
+		t.Fatal("hash of a tuple does not depend on item order")
+	}
+}
+
+func TestCombine(t *testing.T) {
+	type key struct {
+		name []byte
+		n    int
+	}
+
+	h, eq := Combine(
+		Field{Get: func(k interface{}) interface{} { return k.(key).name }, Hash: Bytes, Eq: EqBytes},
+		Field{Get: func(k interface{}) interface{} { return k.(key).n }, Hash: Int, Eq: Equal},
+	)
+	m := hash.New(h, eq, 0)
+	const n = 10000
+	for i := 0; i < n; i++ {
+		m.Insert(key{[]byte(fmt.Sprint(i % 100)), i}, i)
+	}
+	if g, e := m.Len(), n; g != e {
+		t.Fatal(g, e)
+	}
+
+	for i := 0; i < n; i++ {
+		v, ok := m.Get(key{[]byte(fmt.Sprint(i % 100)), i})
+		if !ok || v != i {
+			t.Fatal(i, ok, v)
+		}
+	}
+}
+
+func TestSipHash(t *testing.T) {
+	// Test vectors of the SipHash reference implementation.
+	const k0, k1 = 0x0706050403020100, 0x0f0e0d0c0b0a0908
+	p := make([]byte, 16)
+	for i := range p {
+		p[i] = byte(i)
+	}
+	for _, v := range []struct {
+		n int
+		h uint64
+	}{
+		{0, 0x726fdb47dd0e0e31},
+		{7, 0xab0200f58b01d137},
+		{8, 0x93f5f5799a932462},
+		{15, 0xa129ca6149be45e5},
+	} {
+		if g, e := SipHash(k0, k1, p[:v.n]), v.h; g != e {
+			t.Errorf("len %d: %#x %#x", v.n, g, e)
+		}
+	}
+}
@@ -0,0 +1,150 @@
+// Copyright 2017 The hash Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package hashfn provides hash and equality functions usable with the Maps of
+// package hash, and combinators building such functions for composite keys
+// from the functions of their fields.
+//
+// For example, a Map keyed by ([]byte, int, *big.Int) triples can be created
+// by
+//
+//	h, eq := hashfn.Tuple3(hashfn.Bytes, hashfn.EqBytes, hashfn.Int, hashfn.Equal, hashfn.BigInt, hashfn.EqBigInt)
+//	m := hash.New(h, eq, 0)
+//	m.Insert(hashfn.Tuple{[]byte("foo"), 42, big.NewInt(314)}, v)
+package hashfn
+
+import (
+	"bytes"
+	"math/big"
+)
+
+const (
+	offset64 = 14695981039346656037
+	prime64  = 1099511628211
+
+	basis = int64(offset64 - 1<<64)
+)
+
+// Hash is a hash function. It takes a key and returns its hash.
+type Hash func(k interface{}) int64
+
+// Eq is an equality function. It takes two keys and returns whether they are
+// equal.
+type Eq func(a, b interface{}) bool
+
+// Tuple is a composite key. Its items are hashed and compared by the
+// functions passed to Tuple2, Tuple3 or Combine.
+type Tuple []interface{}
+
+// Field describes one field of a composite key.
+type Field struct {
+	// Get takes a key and returns the field value. If Get is nil the key
+	// must be a Tuple and the field value is the Tuple item at the same
+	// index as the Field is passed to Combine.
+	Get func(k interface{}) interface{}
+
+	Hash Hash // Hash function of the field values.
+	Eq   Eq   // Equality function of the field values.
+}
+
+// Mix returns h combined with the hash v. Mix is not commutative, combining
+// the same hashes in different order produces, with high probability,
+// different results.
+func Mix(h, v int64) int64 {
+	x := uint64(h)*prime64 ^ uint64(v)
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return int64(x)
+}
+
+// Combine returns the hash and equality functions of composite keys made of
+// fields.
+func Combine(fields ...Field) (Hash, Eq) {
+	fields = append([]Field(nil), fields...)
+	get := func(k interface{}, i int) interface{} {
+		if f := fields[i].Get; f != nil {
+			return f(k)
+		}
+
+		return k.(Tuple)[i]
+	}
+	h := func(k interface{}) int64 {
+		r := basis
+		for i, f := range fields {
+			r = Mix(r, f.Hash(get(k, i)))
+		}
+		return r
+	}
+	eq := func(a, b interface{}) bool {
+		for i, f := range fields {
+			if !f.Eq(get(a, i), get(b, i)) {
+				return false
+			}
+		}
+		return true
+	}
+	return h, eq
+}
+
+// Tuple2 returns the hash and equality functions of Tuple keys having two
+// items, hashed by h1, h2 and compared by e1, e2.
+func Tuple2(h1 Hash, e1 Eq, h2 Hash, e2 Eq) (Hash, Eq) {
+	return Combine(Field{Hash: h1, Eq: e1}, Field{Hash: h2, Eq: e2})
+}
+
+// Tuple3 returns the hash and equality functions of Tuple keys having three
+// items, hashed by h1, h2, h3 and compared by e1, e2, e3.
+func Tuple3(h1 Hash, e1 Eq, h2 Hash, e2 Eq, h3 Hash, e3 Eq) (Hash, Eq) {
+	return Combine(Field{Hash: h1, Eq: e1}, Field{Hash: h2, Eq: e2}, Field{Hash: h3, Eq: e3})
+}
+
+// Bytes returns the FNV-1a hash of k, which must be a []byte.
+func Bytes(k interface{}) int64 {
+	h := uint64(offset64)
+	for _, c := range k.([]byte) {
+		h ^= uint64(c)
+		h *= prime64
+	}
+	return int64(h)
+}
+
+// EqBytes reports whether a and b, which must be []byte, are equal.
+func EqBytes(a, b interface{}) bool { return bytes.Equal(a.([]byte), b.([]byte)) }
+
+// String returns the FNV-1a hash of k, which must be a string.
+func String(k interface{}) int64 {
+	s := k.(string)
+	h := uint64(offset64)
+	for i := 0; i < len(s); i++ {
+		h ^= uint64(s[i])
+		h *= prime64
+	}
+	return int64(h)
+}
+
+// Int returns the hash of k, which must be an int.
+func Int(k interface{}) int64 { return Mix(basis, int64(k.(int))) }
+
+// Int64 returns the hash of k, which must be an int64.
+func Int64(k interface{}) int64 { return Mix(basis, k.(int64)) }
+
+// BigInt returns the hash of k, which must be a *big.Int.
+func BigInt(k interface{}) int64 {
+	n := k.(*big.Int)
+	r := Mix(basis, int64(n.Sign()))
+	for _, v := range n.Bits() {
+		r = Mix(r, int64(v))
+	}
+	return r
+}
+
+// EqBigInt reports whether a and b, which must be *big.Int, are equal.
+func EqBigInt(a, b interface{}) bool { return a.(*big.Int).Cmp(b.(*big.Int)) == 0 }
+
+// Equal reports whether a == b. It can be used for keys or fields of
+// comparable types.
+func Equal(a, b interface{}) bool { return a == b }
@@ -0,0 +1,52 @@
+// Copyright 2017 The hash Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package hash
+
+import (
+	"hash/maphash"
+	"sync"
+)
+
+// NewMaphash returns a newly created Map hashing its keys using hash/maphash.
+// The writeKey function takes a key and writes its hashable part to h, for
+// example using h.Write, h.WriteString or maphash.WriteComparable. The
+// WriteBytes, WriteString and WriteComparable functions can be used directly
+// for the common key types. The eq function takes two keys and returns whether
+// they are equal.
+//
+// Every Map returned by NewMaphash uses its own random seed. Hashes are thus
+// not stable across maps or processes.
+func NewMaphash(writeKey func(h *maphash.Hash, k interface{} /*K*/), eq func(a, b interface{} /*K*/) bool, initialCapacity int) *Map {
+	seed := maphash.MakeSeed()
+	pool := sync.Pool{
+		New: func() interface{} {
+			h := &maphash.Hash{}
+			h.SetSeed(seed)
+			return h
+		},
+	}
+	return New(
+		func(k interface{} /*K*/) int64 {
+			h := pool.Get().(*maphash.Hash)
+			h.Reset()
+			writeKey(h, k)
+			r := int64(h.Sum64())
+			pool.Put(h)
+			return r
+		},
+		eq,
+		initialCapacity,
+	)
+}
+
+// WriteBytes writes k, which must be a []byte, to h.
+func WriteBytes(h *maphash.Hash, k interface{}) { h.Write(k.([]byte)) }
+
+// WriteString writes k, which must be a string, to h.
+func WriteString(h *maphash.Hash, k interface{}) { h.WriteString(k.(string)) }
+
+// WriteComparable writes k, which must be a T, to h using
+// maphash.WriteComparable.
+func WriteComparable[T comparable](h *maphash.Hash, k interface{}) { maphash.WriteComparable(h, k.(T)) }
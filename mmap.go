@@ -0,0 +1,238 @@
+// Copyright 2017 The hash Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package hash
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/bits"
+)
+
+// The immutable format written by Build is
+//
+//	header	  [32]byte: magic, version, number of items, number of buckets
+//		  and the hash fingerprint
+//	offsets	  [buckets+1]uint64: file offsets of the buckets, the last one
+//		  is the file size
+//	buckets	  items of every bucket: 8 byte hash, uvarint key length,
+//		  uvarint value length, key, value
+//
+// All integers are little endian.
+const (
+	mmapMagic   = "lhmmap\x00"
+	mmapVersion = 1
+	mmapHdr     = 32
+)
+
+// mmapProbe is the key whose hash is stored in the header, detecting use of a
+// different hash function by OpenMmap.
+var mmapProbe = []byte("github.com/cznic/hash.MappedMap")
+
+// Build writes the items enumerated by c, which must have []byte keys and
+// []byte or nil values, to w in an immutable format served by OpenMmap. The
+// keys are hashed by the hash function of the Map of c. Build returns an error
+// if c was already used up, the Map of c is then unknown.
+func Build(w io.Writer, c *Cursor) error {
+	type entry struct {
+		h    uint64
+		k, v []byte
+	}
+
+	m := c.m
+	if m == nil {
+		if err := c.Err(); err != nil {
+			return err
+		}
+
+		return fmt.Errorf("hash: Build: exhausted cursor")
+	}
+
+	var a []entry
+	for c.Next() {
+		k, ok := c.K.([]byte)
+		if !ok {
+			return fmt.Errorf("hash: Build: key of type %T, expected []byte", c.K)
+		}
+
+		var v []byte
+		if c.V != nil {
+			if v, ok = c.V.([]byte); !ok {
+				return fmt.Errorf("hash: Build: value of type %T, expected []byte", c.V)
+			}
+		}
+
+		a = append(a, entry{uint64(m.hash(k)), k, v})
+	}
+	if err := c.Err(); err != nil {
+		return err
+	}
+
+	nb := uint64(1) << bits.Len(uint(max(len(a), 1)-1))
+	cnt := make([]int, nb+1)
+	size := make([]uint64, nb)
+	for _, v := range a {
+		b := v.h & (nb - 1)
+		cnt[b+1]++
+		size[b] += 8 + uint64(uvarintLen(uint64(len(v.k)))+uvarintLen(uint64(len(v.v)))+len(v.k)+len(v.v))
+	}
+	for i := 1; i < len(cnt); i++ {
+		cnt[i] += cnt[i-1]
+	}
+	sorted := make([]entry, len(a))
+	for _, v := range a {
+		b := v.h & (nb - 1)
+		sorted[cnt[b]] = v
+		cnt[b]++
+	}
+
+	bw := bufio.NewWriter(w)
+	var b []byte
+	b = append(b, mmapMagic...)
+	b = append(b, mmapVersion)
+	b = binary.LittleEndian.AppendUint64(b, uint64(len(a)))
+	b = binary.LittleEndian.AppendUint64(b, nb)
+	b = binary.LittleEndian.AppendUint64(b, uint64(m.hash(mmapProbe)))
+	off := uint64(mmapHdr) + 8*(nb+1)
+	for _, v := range size {
+		b = binary.LittleEndian.AppendUint64(b, off)
+		off += v
+	}
+	b = binary.LittleEndian.AppendUint64(b, off)
+	if _, err := bw.Write(b); err != nil {
+		return err
+	}
+
+	for _, v := range sorted {
+		b = binary.LittleEndian.AppendUint64(b[:0], v.h)
+		b = binary.AppendUvarint(b, uint64(len(v.k)))
+		b = binary.AppendUvarint(b, uint64(len(v.v)))
+		b = append(b, v.k...)
+		b = append(b, v.v...)
+		if _, err := bw.Write(b); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+func uvarintLen(n uint64) int {
+	var b [binary.MaxVarintLen64]byte
+	return binary.PutUvarint(b[:], n)
+}
+
+// MappedMap is an immutable map of []byte keys to []byte values served from
+// a file written by Build. A MappedMap is safe for concurrent use by multiple
+// goroutines.
+type MappedMap struct {
+	data  []byte
+	hash  func(interface{}) int64
+	len   int
+	mask  uint64
+	unmap func() error
+}
+
+// OpenMmap returns a MappedMap serving the file at path, written by Build. The
+// file is mapped into memory where supported, otherwise it is read. The hash
+// function must be the hash function of the Map the file was built from,
+// which is checked using a fingerprint stored in the file.
+func OpenMmap(path string, hash func(interface{}) int64) (*MappedMap, error) {
+	data, unmap, err := mmap(path)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &MappedMap{data: data, hash: hash, unmap: unmap}
+	if err := m.check(); err != nil {
+		unmap()
+		return nil, fmt.Errorf("hash: OpenMmap %s: %v", path, err)
+	}
+
+	return m, nil
+}
+
+func (m *MappedMap) check() error {
+	b := m.data
+	if len(b) < mmapHdr || string(b[:len(mmapMagic)]) != mmapMagic {
+		return fmt.Errorf("invalid format")
+	}
+
+	if v := b[len(mmapMagic)]; v != mmapVersion {
+		return fmt.Errorf("unsupported version %d", v)
+	}
+
+	n := binary.LittleEndian.Uint64(b[8:])
+	nb := binary.LittleEndian.Uint64(b[16:])
+	if nb == 0 || nb&(nb-1) != 0 || uint64(len(b)-mmapHdr)/8 < nb+1 || n > uint64(len(b)) {
+		return fmt.Errorf("invalid format")
+	}
+
+	if binary.LittleEndian.Uint64(b[24:]) != uint64(m.hash(mmapProbe)) {
+		return fmt.Errorf("hash function fingerprint mismatch")
+	}
+
+	if m.offset(0) != mmapHdr+8*(nb+1) || m.offset(nb) != uint64(len(b)) {
+		return fmt.Errorf("invalid format")
+	}
+
+	m.len = int(n)
+	m.mask = nb - 1
+	return nil
+}
+
+func (m *MappedMap) offset(i uint64) uint64 {
+	return binary.LittleEndian.Uint64(m.data[mmapHdr+8*i:])
+}
+
+// Close releases the resources of m. The values returned by Get must not be
+// used after Close.
+func (m *MappedMap) Close() error {
+	m.data = nil
+	return m.unmap()
+}
+
+// Get returns the value associated with k and true, or nil and false if k is
+// not in m. The returned value points into the memory of m and must not be
+// modified.
+func (m *MappedMap) Get(k []byte) ([]byte, bool) {
+	h := uint64(m.hash(k))
+	a := h & m.mask
+	b := m.data
+	off, end := m.offset(a), m.offset(a+1)
+	if off > end || end > uint64(len(b)) {
+		return nil, false
+	}
+
+	b = b[off:end]
+	for len(b) > 8 {
+		eh := binary.LittleEndian.Uint64(b)
+		kl, n1 := binary.Uvarint(b[8:])
+		if n1 <= 0 {
+			return nil, false
+		}
+
+		vl, n2 := binary.Uvarint(b[8+n1:])
+		if n2 <= 0 {
+			return nil, false
+		}
+
+		b = b[8+n1+n2:]
+		if kl > uint64(len(b)) || vl > uint64(len(b))-kl {
+			return nil, false
+		}
+
+		if eh == h && bytes.Equal(b[:kl], k) {
+			return b[kl : kl+vl : kl+vl], true
+		}
+
+		b = b[kl+vl:]
+	}
+	return nil, false
+}
+
+// Len returns the number of items in m.
+func (m *MappedMap) Len() int { return m.len }
@@ -0,0 +1,19 @@
+// Copyright 2017 The hash Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !unix
+
+package hash
+
+import (
+	"os"
+)
+
+func mmap(path string) (data []byte, unmap func() error, err error) {
+	if data, err = os.ReadFile(path); err != nil {
+		return nil, nil, err
+	}
+
+	return data, func() error { return nil }, nil
+}
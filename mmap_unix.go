@@ -0,0 +1,38 @@
+// Copyright 2017 The hash Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build unix
+
+package hash
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+func mmap(path string) (data []byte, unmap func() error, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	sz := fi.Size()
+	if sz == 0 || sz != int64(int(sz)) {
+		return nil, nil, fmt.Errorf("hash: cannot map %s: invalid size %d", path, sz)
+	}
+
+	if data, err = syscall.Mmap(int(f.Fd()), 0, int(sz), syscall.PROT_READ, syscall.MAP_SHARED); err != nil {
+		return nil, nil, err
+	}
+
+	return data, func() error { return syscall.Munmap(data) }, nil
+}
@@ -0,0 +1,17 @@
+// Copyright 2017 The hash Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !hashdebug
+
+package hash
+
+type itemDebug struct{}
+
+func newItemDebug(h int64) (r itemDebug) { return r }
+
+func (m *Map) debugHash(op string, h int64, k interface{} /*K*/) {}
+
+func (m *Map) debugTouch(op string, a uint, b []item) {}
+
+func (m *Map) debugEq(op string, a, b interface{} /*K*/) bool { return true }